@@ -0,0 +1,51 @@
+//go:build linux
+
+package buse
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// cpuSet is a cpu_set_t of the glibc, room for 1024 CPUs
+type cpuSet [16]uint64
+
+func (s *cpuSet) has(cpu int) bool {
+	return s[cpu/64]&(1<<(cpu%64)) != 0
+}
+
+func schedAffinity(op uintptr, set *cpuSet) error {
+	_, _, ep := syscall.RawSyscall(op, 0, unsafe.Sizeof(*set), uintptr(unsafe.Pointer(set)))
+	if ep != 0 {
+		return ep
+	}
+	return nil
+}
+
+// pinThread locks the calling goroutine to its thread and restricts the
+// thread to cpus, checked against the CPUs the process may use. The
+// returned func restores the affinity and unlocks the thread.
+func pinThread(cpus []int) (func(), error) {
+	var allowed, set cpuSet
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &allowed); err != nil {
+		return nil, fmt.Errorf("Cannot get the CPU affinity: %s", err)
+	}
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= len(set)*64 || !allowed.has(cpu) {
+			return nil, fmt.Errorf("CPU %d is not available to the process", cpu)
+		}
+		set[cpu/64] |= 1 << (cpu % 64)
+	}
+	runtime.LockOSThread()
+	if err := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &set); err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("Cannot set the CPU affinity: %s", err)
+	}
+	return func() {
+		// The thread goes back to the runtime, it must not stay pinned
+		schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &allowed)
+		runtime.UnlockOSThread()
+	}, nil
+}
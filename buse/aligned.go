@@ -0,0 +1,250 @@
+package buse
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// maxPendingBlocks bounds the partial blocks an AlignedDevice keeps before
+// writing them back
+const maxPendingBlocks = 64
+
+// pendingBlock is a block partially written by the kernel, sectors tells
+// which of its sectors hold data not in the backend yet
+type pendingBlock struct {
+	data    []byte
+	sectors uint64
+}
+
+// AlignedDevice adapts the requests of the kernel, 1 KiB by default, to a
+// driver with a larger native block size. Partial block writes are held
+// until the block is complete and then written in one go, only the blocks
+// still partial on flush are read-modify-written. The last blocks read are
+// kept so that consecutive small reads cost a single backend read.
+// Optional interfaces of the inner driver are hidden.
+type AlignedDevice struct {
+	BuseInterface
+	blockSize uint64
+	full      uint64
+	mu        sync.Mutex
+	pending   map[uint64]*pendingBlock
+	// aligned range last read from the driver
+	cacheOff uint64
+	cache    []byte
+}
+
+// NewAlignedDevice wraps the inner driver, whose native block size is
+// blockSize, a multiple of 512 up to 32 KiB
+func NewAlignedDevice(inner BuseInterface, blockSize uint64) (*AlignedDevice, error) {
+	if blockSize == 0 || blockSize%sectorSize != 0 || blockSize/sectorSize > 64 {
+		return nil, fmt.Errorf("Invalid native block size: %d", blockSize)
+	}
+	return &AlignedDevice{
+		BuseInterface: inner,
+		blockSize:     blockSize,
+		full:          1<<(blockSize/sectorSize) - 1,
+		pending:       make(map[uint64]*pendingBlock),
+	}, nil
+}
+
+// sectorMask returns the sectors of a block touched by length bytes at
+// inBlock, and whether they are all fully covered
+func (d *AlignedDevice) sectorMask(inBlock, length uint64) (mask uint64, whole bool) {
+	first := inBlock / sectorSize
+	last := (inBlock + length + sectorSize - 1) / sectorSize
+	mask = (1<<(last-first) - 1) << first
+	whole = inBlock%sectorSize == 0 && (inBlock+length)%sectorSize == 0
+	return mask, whole
+}
+
+// merge reads a block from the driver and lays the pending sectors over it
+func (d *AlignedDevice) merge(index uint64, b *pendingBlock) error {
+	buf := make([]byte, d.blockSize)
+	if err := d.BuseInterface.ReadAt(buf, index*d.blockSize); err != nil {
+		return err
+	}
+	for s := b.sectors; s != 0; s &= s - 1 {
+		i := uint64(bits.TrailingZeros64(s)) * sectorSize
+		copy(buf[i:i+sectorSize], b.data[i:])
+	}
+	b.data = buf
+	b.sectors = d.full
+	return nil
+}
+
+// writeBack writes the pending blocks to the driver
+func (d *AlignedDevice) writeBack() error {
+	d.cache = nil
+	for index, b := range d.pending {
+		if b.sectors != d.full {
+			if err := d.merge(index, b); err != nil {
+				return err
+			}
+		}
+		if err := d.BuseInterface.WriteAt(b.data, index*d.blockSize); err != nil {
+			return err
+		}
+		delete(d.pending, index)
+	}
+	return nil
+}
+
+// dropCache forgets the read cache if it overlaps a range
+func (d *AlignedDevice) dropCache(off, end uint64) {
+	if d.cache != nil && d.cacheOff < end && off < d.cacheOff+uint64(len(d.cache)) {
+		d.cache = nil
+	}
+}
+
+// dropPending forgets the pending data of the blocks first to last excluded
+func (d *AlignedDevice) dropPending(first, last uint64) {
+	for index := range d.pending {
+		if index >= first && index < last {
+			delete(d.pending, index)
+		}
+	}
+}
+
+func (d *AlignedDevice) ReadAt(p []byte, off uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	end := off + uint64(len(p))
+	if d.cache == nil || off < d.cacheOff || end > d.cacheOff+uint64(len(d.cache)) {
+		start := off / d.blockSize * d.blockSize
+		buf := make([]byte, (end+d.blockSize-1)/d.blockSize*d.blockSize-start)
+		if err := d.BuseInterface.ReadAt(buf, start); err != nil {
+			return err
+		}
+		d.cacheOff, d.cache = start, buf
+	}
+	copy(p, d.cache[off-d.cacheOff:])
+	// The pending sectors are newer than the driver
+	for index, b := range d.pending {
+		bOff := index * d.blockSize
+		if bOff >= end || bOff+d.blockSize <= off {
+			continue
+		}
+		for s := b.sectors; s != 0; s &= s - 1 {
+			sOff := bOff + uint64(bits.TrailingZeros64(s))*sectorSize
+			lo, hi := max(sOff, off), min(sOff+sectorSize, end)
+			if lo < hi {
+				copy(p[lo-off:hi-off], b.data[lo-bOff:])
+			}
+		}
+	}
+	return nil
+}
+
+func (d *AlignedDevice) WriteAt(p []byte, off uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	end := off + uint64(len(p))
+	d.dropCache(off, end)
+	pos := off
+	if pos%d.blockSize != 0 {
+		n := min(end, (pos/d.blockSize+1)*d.blockSize) - pos
+		if err := d.writePartial(p[:n], pos); err != nil {
+			return err
+		}
+		pos += n
+	}
+	if wholeEnd := end / d.blockSize * d.blockSize; pos < wholeEnd {
+		// The whole blocks go straight to the driver
+		d.dropPending(pos/d.blockSize, wholeEnd/d.blockSize)
+		if err := d.BuseInterface.WriteAt(p[pos-off:wholeEnd-off], pos); err != nil {
+			return err
+		}
+		pos = wholeEnd
+	}
+	if pos < end {
+		if err := d.writePartial(p[pos-off:], pos); err != nil {
+			return err
+		}
+	}
+	if len(d.pending) > maxPendingBlocks {
+		return d.writeBack()
+	}
+	return nil
+}
+
+// writePartial holds the data of a write within a single block
+func (d *AlignedDevice) writePartial(p []byte, off uint64) error {
+	index, inBlock := off/d.blockSize, off%d.blockSize
+	b, ok := d.pending[index]
+	if !ok {
+		b = &pendingBlock{data: make([]byte, d.blockSize)}
+		d.pending[index] = b
+	}
+	mask, whole := d.sectorMask(inBlock, uint64(len(p)))
+	if !whole && b.sectors&mask != mask {
+		// Sectors partly written, fill them from the driver first
+		if err := d.merge(index, b); err != nil {
+			return err
+		}
+	}
+	copy(b.data[inBlock:], p)
+	b.sectors |= mask
+	if b.sectors != d.full {
+		return nil
+	}
+	delete(d.pending, index)
+	return d.BuseInterface.WriteAt(b.data, index*d.blockSize)
+}
+
+// Trim only discards the whole blocks of the range, it is a hint anyway
+func (d *AlignedDevice) Trim(off, length uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	start := (off + d.blockSize - 1) / d.blockSize
+	end := (off + length) / d.blockSize
+	if end <= start {
+		return nil
+	}
+	d.dropCache(start*d.blockSize, end*d.blockSize)
+	d.dropPending(start, end)
+	return d.BuseInterface.Trim(start*d.blockSize, (end-start)*d.blockSize)
+}
+
+func (d *AlignedDevice) WriteZeroes(off, length uint64) error {
+	start := (off + d.blockSize - 1) / d.blockSize * d.blockSize
+	end := (off + length) / d.blockSize * d.blockSize
+	if end <= start {
+		return d.WriteAt(make([]byte, length), off)
+	}
+	if start > off {
+		if err := d.WriteAt(make([]byte, start-off), off); err != nil {
+			return err
+		}
+	}
+	d.mu.Lock()
+	d.dropCache(start, end)
+	d.dropPending(start/d.blockSize, end/d.blockSize)
+	err := writeZeroes(d.BuseInterface, start, end-start)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if off+length > end {
+		return d.WriteAt(make([]byte, off+length-end), end)
+	}
+	return nil
+}
+
+// Flush writes back the partial blocks before flushing the driver
+func (d *AlignedDevice) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.writeBack(); err != nil {
+		return err
+	}
+	return d.BuseInterface.Flush()
+}
+
+// Disconnect writes back the partial blocks, errors are lost
+func (d *AlignedDevice) Disconnect() {
+	d.mu.Lock()
+	d.writeBack()
+	d.mu.Unlock()
+	d.BuseInterface.Disconnect()
+}
@@ -0,0 +1,88 @@
+package buse
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BarrierDevice wraps a driver whose writes may land in any order until
+// flushed, to order them: at a barrier the inner driver is flushed, so the
+// writes before it are durable before any write after it reaches the
+// driver. Flushes are barriers and Barrier inserts one, NewBarrierDevice
+// can also add one every N writes. After a failed barrier, writes are
+// refused until a barrier succeeds, so that none lands ahead of the writes
+// it failed to make durable. Optional interfaces of the inner driver are
+// hidden.
+type BarrierDevice struct {
+	BuseInterface
+	every int
+	mu    sync.Mutex
+	// writes since the last barrier
+	writes int
+	err    error
+}
+
+// NewBarrierDevice wraps the inner driver. A non zero every adds a barrier
+// after each run of that number of writes, on top of the flushes.
+func NewBarrierDevice(inner BuseInterface, every int) *BarrierDevice {
+	return &BarrierDevice{BuseInterface: inner, every: every}
+}
+
+// barrier flushes the inner driver, the lock must be held
+func (d *BarrierDevice) barrier() error {
+	if err := d.BuseInterface.Flush(); err != nil {
+		d.err = err
+		return err
+	}
+	d.writes = 0
+	d.err = nil
+	return nil
+}
+
+// Barrier makes the writes done so far durable before the next ones
+func (d *BarrierDevice) Barrier() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.barrier()
+}
+
+// write runs a write once the barriers before it succeeded
+func (d *BarrierDevice) write(off, length uint64, write func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return fmt.Errorf("Write refused after a failed barrier (offset:%d len:%d): %w", off, length, d.err)
+	}
+	if d.every > 0 && d.writes >= d.every {
+		if err := d.barrier(); err != nil {
+			return err
+		}
+	}
+	d.writes++
+	return write()
+}
+
+func (d *BarrierDevice) WriteAt(p []byte, off uint64) error {
+	return d.write(off, uint64(len(p)), func() error {
+		return d.BuseInterface.WriteAt(p, off)
+	})
+}
+
+func (d *BarrierDevice) WriteZeroes(off, length uint64) error {
+	return d.write(off, length, func() error {
+		return writeZeroes(d.BuseInterface, off, length)
+	})
+}
+
+func (d *BarrierDevice) Trim(off, length uint64) error {
+	return d.write(off, length, func() error {
+		return d.BuseInterface.Trim(off, length)
+	})
+}
+
+// Flush is a barrier, it clears a previous failure when it succeeds
+func (d *BarrierDevice) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.barrier()
+}
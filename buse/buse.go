@@ -1,186 +1,722 @@
 package buse
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
-func ioctl(fd, op, arg uintptr) {
-	_, _, ep := syscall.Syscall(syscall.SYS_IOCTL, fd, op, arg)
-	if ep != 0 {
-		log.Fatalf("ioctl(%d, %d, %d) failed: %s", fd, op, arg, syscall.Errno(ep))
+var errDisconnect = fmt.Errorf("Received a disconnect")
+
+// ErrNotSupported may be returned by drivers for operations they do not
+// implement, it is replied as ENOTSUP rather than as a failure
+var ErrNotSupported = errors.New("operation not supported")
+
+// ErrUnwritten may be returned by ReadAt for regions never written, they
+// are then read as zeroes if Options.ZeroFillUnwritten is set
+var ErrUnwritten = errors.New("region never written")
+
+// ErrUnavailable may be returned by drivers whose backend is temporarily
+// unreachable, the call is then retried as told by Options.RetryUnavailable
+// and replied as EIO if it keeps failing
+var ErrUnavailable = errors.New("backend unavailable")
+
+// ErrReadOnly is returned by read-only drivers when asked to modify data
+var ErrReadOnly = errors.New("read-only device")
+
+// ErrDeviceRemoved is returned by Connect when the device is disconnected
+// from outside the process, e.g. by nbd-client -d or its socket cleared by
+// another program, or when the device file disappears.
+var ErrDeviceRemoved = errors.New("nbd device removed")
+
+// ErrUnsupportedPlatform is returned for what needs Linux, e.g. creating a
+// kernel device, when built for another platform. Serve and the drivers
+// work everywhere.
+var ErrUnsupportedPlatform = errors.New("not supported on this platform")
+
+// ErrReplyStalled is returned by Connect and Serve when writing a reply
+// blocked for longer than Options.ReplyWriteTimeout
+var ErrReplyStalled = errors.New("reply write stalled")
+
+func (bd *BuseDevice) opDeviceRead(fp io.ReadWriter, chunk []byte, request *Request, reply *Reply) error {
+	if request.Length == 0 {
+		// Nothing to read, the driver is not bothered with it
+		bd.sendReply(fp, request, reply, nil)
+		return nil
+	}
+	zero := false
+	if z, ok := bd.driver.(ZeroReporter); ok {
+		// A panic leaves it false, the driver is read
+		bd.recovering(func() error { zero = z.IsZero(request.From, uint64(request.Length)); return nil })()
+	}
+	if zero {
+		// The chunk may come from a driver, not zeroed
+		clear(chunk)
+		bd.sendReply(fp, request, reply, chunk)
+		return nil
 	}
+	err := bd.callDriver(request, func() error { return bd.driver.ReadAt(chunk, request.From) })
+	if err != nil && bd.options().ZeroFillUnwritten && errors.Is(err, ErrUnwritten) {
+		clear(chunk)
+		err = nil
+	}
+	if err != nil {
+		log.Printf("buseDriver.ReadAt returned an error (offset:%d len:%d handle:%s): %s", request.From, request.Length, bd.handle(request.Handle), err)
+		reply.Error = errorCode(err)
+		// The kernel does not read the data of a failed read
+		chunk = nil
+	}
+	bd.sendReply(fp, request, reply, chunk)
+	return nil
 }
 
-func opDeviceRead(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
-	if err := driver.ReadAt(chunk, uint(request.From)); err != nil {
-		log.Println("buseDriver.ReadAt returned an error:", err)
-		// Reply with an EPERM
-		reply.Error = 1
+func (bd *BuseDevice) opDeviceWrite(fp io.ReadWriter, chunk []byte, request *Request, reply *Reply) error {
+	if _, err := io.ReadFull(fp, chunk); err != nil {
+		return fmt.Errorf("Fatal error, cannot read WRITE request payload: %s", err)
 	}
-	buf := writeNbdReply(reply)
-	if _, err := fp.Write(buf); err != nil {
-		log.Println("Write error, when sending reply header:", err)
+	if request.Length == 0 {
+		// Nothing to write, the driver is not bothered with it
+		bd.sendReply(fp, request, reply, nil)
+		return nil
 	}
-	if _, err := fp.Write(chunk); err != nil {
-		log.Println("Write error, when sending data chunk:", err)
+	if bd.isProtected(request) {
+		reply.Error = NBD_EPERM
+		bd.sendReply(fp, request, reply, nil)
+		return nil
 	}
+	bd.unflushed = true
+	if err := bd.callDriver(request, func() error { return bd.driver.WriteAt(chunk, request.From) }); err != nil {
+		log.Printf("buseDriver.WriteAt returned an error (offset:%d len:%d handle:%s): %s", request.From, request.Length, bd.handle(request.Handle), err)
+		reply.Error = errorCode(err)
+	}
+	bd.sendReply(fp, request, reply, nil)
 	return nil
 }
 
-func opDeviceWrite(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
-	if _, err := io.ReadFull(fp, chunk); err != nil {
-		return fmt.Errorf("Fatal error, cannot read request packet: %s", err)
+func (bd *BuseDevice) opDeviceDisconnect(fp io.ReadWriter, chunk []byte, request *Request, reply *Reply) error {
+	if bd.options().DisconnectMode == FlushPending {
+		if err := bd.callDriver(request, bd.driver.Flush); err != nil {
+			log.Println("buseDriver.Flush returned an error before disconnecting:", err)
+		}
 	}
-	if err := driver.WriteAt(chunk, uint(request.From)); err != nil {
-		log.Println("buseDriver.WriteAt returned an error:", err)
-		reply.Error = 1
+	bd.disconnectDriver()
+	return errDisconnect
+}
+
+// disconnectDriver calls the Disconnect of the driver once, from the DISC
+// handler or from teardown when the kernel sent none, e.g. with
+// DiscardPending or Close. The caller holds the gate.
+func (bd *BuseDevice) disconnectDriver() {
+	bd.disconnectOnce.Do(func() {
+		log.Println("Calling buseDriver.Disconnect()")
+		bd.driver.Disconnect()
+	})
+}
+
+func (bd *BuseDevice) opDeviceFlush(fp io.ReadWriter, chunk []byte, request *Request, reply *Reply) error {
+	dirty := true
+	if d, ok := bd.driver.(DirtyReporter); ok {
+		// A panic leaves it true, the driver is flushed
+		bd.recovering(func() error { dirty = d.IsDirty(); return nil })()
 	}
-	buf := writeNbdReply(reply)
-	if _, err := fp.Write(buf); err != nil {
-		log.Println("Write error, when sending reply header:", err)
+	if !dirty {
+		// Nothing to flush
+		bd.sendReply(fp, request, reply, nil)
+		return nil
 	}
+	if bd.options().CoalesceFlushes && !bd.unflushed {
+		// The previous flush already covers every acknowledged write
+		bd.stats.coalescedFlushes.Add(1)
+		bd.sendReply(fp, request, reply, nil)
+		return nil
+	}
+	if rf, ok := bd.driver.(RangeFlusher); ok && request.Length != 0 {
+		// Only part of the data is flushed, unflushed stays as it is
+		if err := bd.callDriver(request, func() error { return rf.FlushRange(request.From, uint64(request.Length)) }); err != nil {
+			log.Printf("buseDriver.FlushRange returned an error (offset:%d len:%d handle:%s): %s", request.From, request.Length, bd.handle(request.Handle), err)
+			reply.Error = errorCode(err)
+		}
+		bd.sendReply(fp, request, reply, nil)
+		return nil
+	}
+	bd.unflushed = false
+	if err := bd.callDriver(request, bd.driver.Flush); err != nil {
+		log.Printf("buseDriver.Flush returned an error (offset:%d len:%d handle:%s): %s", request.From, request.Length, bd.handle(request.Handle), err)
+		reply.Error = errorCode(err)
+		bd.unflushed = true
+	}
+	bd.sendReply(fp, request, reply, nil)
 	return nil
 }
 
-func opDeviceDisconnect(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
-	log.Println("Calling buseDriver.Disconnect()")
-	driver.Disconnect()
-	return fmt.Errorf("Received a disconnect")
+func (bd *BuseDevice) opDeviceTrim(fp io.ReadWriter, chunk []byte, request *Request, reply *Reply) error {
+	if bd.isProtected(request) {
+		reply.Error = NBD_EPERM
+		bd.sendReply(fp, request, reply, nil)
+		return nil
+	}
+	bd.unflushed = true
+	trim := func() error { return bd.driver.Trim(request.From, uint64(request.Length)) }
+	if ft, ok := bd.driver.(FreeingTrimmer); ok {
+		trim = func() error {
+			freed, err := ft.TrimFreeing(request.From, uint64(request.Length))
+			bd.stats.freedBytes.Add(freed)
+			return err
+		}
+	}
+	err := bd.callDriver(request, trim)
+	// Discarding is a hint, a driver unable to do it did not fail
+	if err != nil && !errors.Is(err, ErrNotSupported) {
+		log.Printf("buseDriver.Trim returned an error (offset:%d len:%d handle:%s): %s", request.From, request.Length, bd.handle(request.Handle), err)
+		reply.Error = errorCode(err)
+	}
+	bd.sendReply(fp, request, reply, nil)
+	return nil
 }
 
-func opDeviceFlush(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
-	if err := driver.Flush(); err != nil {
-		log.Println("buseDriver.Flush returned an error:", err)
-		reply.Error = 1
+func (bd *BuseDevice) opDeviceWriteZeroes(fp io.ReadWriter, chunk []byte, request *Request, reply *Reply) error {
+	if bd.isProtected(request) {
+		reply.Error = NBD_EPERM
+		bd.sendReply(fp, request, reply, nil)
+		return nil
 	}
-	buf := writeNbdReply(reply)
-	if _, err := fp.Write(buf); err != nil {
-		log.Println("Write error, when sending reply header:", err)
+	bd.unflushed = true
+	if err := bd.callDriver(request, func() error { return writeZeroes(bd.driver, request.From, uint64(request.Length)) }); err != nil {
+		log.Printf("buseDriver.WriteZeroes returned an error (offset:%d len:%d handle:%s): %s", request.From, request.Length, bd.handle(request.Handle), err)
+		reply.Error = errorCode(err)
 	}
+	bd.sendReply(fp, request, reply, nil)
 	return nil
 }
 
-func opDeviceTrim(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
-	if err := driver.Trim(uint(request.From), uint(request.Length)); err != nil {
-		log.Println("buseDriver.Flush returned an error:", err)
-		reply.Error = 1
+// options returns the current options, Reconfigure replaces them as a whole
+// so that the callers not holding the gate read a consistent snapshot
+func (bd *BuseDevice) options() *Options {
+	return bd.opts.Load()
+}
+
+// currentDriver returns the driver for the callers not holding the gate,
+// which SwapDriver may replace meanwhile
+func (bd *BuseDevice) currentDriver() BuseInterface {
+	bd.driverMu.RLock()
+	defer bd.driverMu.RUnlock()
+	return bd.driver
+}
+
+// handle renders a request handle for the logs, see Options.DecodeHandle
+func (bd *BuseDevice) handle(handle uint64) string {
+	if decode := bd.options().DecodeHandle; decode != nil {
+		// Back to the bytes the kernel sent
+		var raw [8]byte
+		binary.BigEndian.PutUint64(raw[:], handle)
+		return decode(raw)
+	}
+	return fmt.Sprintf("%#x", handle)
+}
+
+// recovering wraps a driver call to recover its panics, see
+// Options.PanicHandler, the call is returned as is without a handler
+func (bd *BuseDevice) recovering(call func() error) func() error {
+	opts := bd.options()
+	if opts.PanicHandler == nil {
+		return call
+	}
+	return func() (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			opts.PanicHandler(r, debug.Stack())
+			err = fmt.Errorf("Driver panicked: %v: %w", r, syscall.EIO)
+			if opts.PanicTeardown {
+				bd.fail(err)
+			}
+		}()
+		return call()
+	}
+}
+
+// Bounds of the backoff between the retries of an unavailable driver
+const (
+	retryMinDelay = 10 * time.Millisecond
+	retryMaxDelay = time.Second
+)
+
+// callDriver runs the driver call serving the request, retrying it while
+// the driver is unavailable if allowed to, and logging it if slow
+func (bd *BuseDevice) callDriver(request *Request, call func() error) error {
+	opts := bd.options()
+	call = bd.recovering(call)
+	start := time.Now()
+	err := call()
+	if errors.Is(err, ErrUnavailable) && opts.RetryUnavailable > 0 {
+		log.Printf("Driver unavailable for %s offset:%d len:%d, retrying for up to %s", commandName(request.Type), request.From, request.Length, opts.RetryUnavailable)
 	}
-	buf := writeNbdReply(reply)
-	if _, err := fp.Write(buf); err != nil {
-		log.Println("Write error, when sending reply header:", err)
+	for delay := retryMinDelay; errors.Is(err, ErrUnavailable) && time.Since(start)+delay <= opts.RetryUnavailable; delay = min(2*delay, retryMaxDelay) {
+		time.Sleep(delay)
+		err = call()
+	}
+	elapsed := time.Since(start)
+	bd.stats.driverTime.Add(int64(elapsed))
+	if threshold := opts.SlowOpThreshold; threshold > 0 && elapsed > threshold {
+		log.Printf("WARNING: slow %s offset:%d len:%d took %s", commandName(request.Type), request.From, request.Length, elapsed)
+	}
+	return err
+}
+
+// Largest write issued when zeroing a range through WriteAt
+const zeroesChunkSize = 1024 * 1024
+
+// writeZeroes zeroes a range, with WriteAt if the driver is no WriteZeroer
+func writeZeroes(driver BuseInterface, off, length uint64) error {
+	if z, ok := driver.(WriteZeroer); ok {
+		if err := z.WriteZeroes(off, length); !errors.Is(err, ErrNotSupported) {
+			return err
+		}
+	}
+	zeroes := make([]byte, min(length, zeroesChunkSize))
+	for length > 0 {
+		n := min(length, uint64(len(zeroes)))
+		if err := driver.WriteAt(zeroes[:n], off); err != nil {
+			return err
+		}
+		off += n
+		length -= n
 	}
 	return nil
 }
 
-func (bd *BuseDevice) startNBDClient() {
-	ioctl(bd.deviceFp.Fd(), NBD_SET_SOCK, uintptr(bd.socketPair[1]))
-	// The call below may fail on some systems (if flags unset), could be ignored
-	ioctl(bd.deviceFp.Fd(), NBD_SET_FLAGS, NBD_FLAG_SEND_TRIM)
-	// The following call will block until the client disconnects
-	log.Println("Starting NBD client...")
-	go ioctl(bd.deviceFp.Fd(), NBD_DO_IT, 0)
-	// Block on the disconnect channel
-	<-bd.disconnect
+func (bd *BuseDevice) progress(request *Request, reply *Reply, done bool) {
+	observe := bd.options().Progress
+	if observe == nil {
+		return
+	}
+	event := ProgressEvent{
+		Command: request.Type & NBD_CMD_MASK_COMMAND,
+		Handle:  request.Handle,
+		Offset:  request.From,
+		Length:  request.Length,
+		Done:    done,
+	}
+	if done {
+		event.Error = reply.Error
+		if command := event.Command; reply.Error == 0 && (command == NBD_CMD_READ || command == NBD_CMD_WRITE) {
+			event.Bytes = uint64(request.Length)
+		}
+	}
+	observe(event)
+}
+
+// isProtected tells whether the request touches one of the protected ranges
+func (bd *BuseDevice) isProtected(request *Request) bool {
+	for _, r := range bd.options().ProtectedRanges {
+		if r.Overlaps(request.From, uint64(request.Length)) {
+			log.Printf("Rejected %s on protected range [%d,%d) (offset:%d len:%d)", commandName(request.Type), r.Start, r.End, request.From, request.Length)
+			return true
+		}
+	}
+	return false
+}
+
+func (bd *BuseDevice) sendReply(fp io.Writer, request *Request, reply *Reply, data []byte) {
+	opts := bd.options()
+	start := time.Now()
+	if timeout := opts.ReplyWriteTimeout; timeout > 0 {
+		// Tearing down closes the socket under the write, which then fails
+		stalled := time.AfterFunc(timeout, func() {
+			bd.fail(fmt.Errorf("%w: %s reply blocked for %s, the peer is not draining replies", ErrReplyStalled, commandName(request.Type), timeout))
+		})
+		defer stalled.Stop()
+	}
+	if err := bd.encoder.WriteReply(fp, reply.Handle, reply.Error, data); err != nil && !bd.closing.Load() {
+		log.Printf("Write error, when sending %s reply: %s", commandName(request.Type), err)
+	}
+	blocked := time.Since(start)
+	bd.stats.replyWriteTime.Add(int64(blocked))
+	if threshold := opts.SlowReplyThreshold; threshold > 0 && blocked > threshold {
+		bd.stats.slowReplyWrites.Add(1)
+		log.Printf("WARNING: %s reply write blocked for %s (handle:%s), the kernel is not draining replies", commandName(request.Type), blocked, bd.handle(reply.Handle))
+		if opts.OnSlowReply != nil {
+			opts.OnSlowReply(blocked)
+		}
+	}
+}
+
+// fail records the first fatal error of the device and tears it down.
+// Errors stay scoped to the device: Connect returns them to its caller
+// instead of taking down the whole process.
+func (bd *BuseDevice) fail(err error) {
+	bd.errMu.Lock()
+	if bd.err == nil {
+		bd.err = err
+	}
+	bd.errMu.Unlock()
+	log.Println("NBD client failed:", err)
+	bd.shutdown()
+}
+
+// failure returns the error recorded by fail, if any
+func (bd *BuseDevice) failure() error {
+	bd.errMu.Lock()
+	defer bd.errMu.Unlock()
+	return bd.err
 }
 
-// Disconnect disconnects the BuseDevice
+// Disconnect disconnects the BuseDevice. It is safe to call it more than once.
+// Pending requests are handled according to Options.DisconnectMode.
+// A driver implementing DisconnectVetoer may refuse it, the device then keeps
+// serving. Disconnections forced by the kernel, by errors or by Close cannot
+// be vetoed.
 func (bd *BuseDevice) Disconnect() {
-	bd.disconnect <- 1
-	// Ok to fail, ignore errors
-	syscall.Syscall(syscall.SYS_IOCTL, bd.deviceFp.Fd(), NBD_CLEAR_QUE, 0)
-	syscall.Syscall(syscall.SYS_IOCTL, bd.deviceFp.Fd(), NBD_DISCONNECT, 0)
-	syscall.Syscall(syscall.SYS_IOCTL, bd.deviceFp.Fd(), NBD_CLEAR_SOCK, 0)
-	// Cleanup fd
-	syscall.Close(bd.socketPair[0])
-	syscall.Close(bd.socketPair[1])
-	bd.deviceFp.Close()
+	bd.DisconnectErr()
+}
+
+// DisconnectErr is Disconnect reporting why the device may not be released:
+// the veto of the driver, or the failures to clear the queue and the socket
+// of the device, which tell it is stuck.
+func (bd *BuseDevice) DisconnectErr() error {
+	if v, ok := bd.currentDriver().(DisconnectVetoer); ok && !bd.closing.Load() {
+		if err := bd.recovering(v.CanDisconnect)(); err != nil {
+			log.Println("Disconnect vetoed by the driver:", err)
+			return fmt.Errorf("Disconnect vetoed by the driver: %w", err)
+		}
+	}
+	// The DISC the kernel sends next is ours, not a removal from outside
+	bd.disconnecting.Store(true)
+	if bd.options().DisconnectMode == FlushPending && bd.connected.Load() && !bd.closing.Load() {
+		bd.drain()
+	}
+	bd.shutdown()
+	return bd.clearErr
+}
+
+// How long a voluntary disconnect waits for the pending requests
+const drainTimeout = 30 * time.Second
+
+// drain asks the kernel to disconnect: it sends a DISC request after the
+// ones already queued, which are served meanwhile, and the DISC handler
+// flushes the driver.
+func (bd *BuseDevice) drain() {
+	bd.Resume()
+	if err := ioctl(bd.deviceFp.Fd(), NBD_DISCONNECT, 0); err != nil {
+		log.Println("Cannot drain the pending requests:", err)
+		return
+	}
+	select {
+	case <-bd.served:
+	case <-time.After(drainTimeout):
+		log.Println("Timed out draining the pending requests")
+	}
+}
+
+// shutdown disconnects the device unconditionally
+func (bd *BuseDevice) shutdown() {
+	bd.closeOnce.Do(bd.teardown)
+}
+
+// Close disconnects the BuseDevice and waits for all its goroutines to exit.
+// It is idempotent and always returns the error of the first teardown.
+func (bd *BuseDevice) Close() error {
+	bd.shutdown()
+	bd.wg.Wait()
+	return bd.closeErr
+}
+
+func (bd *BuseDevice) teardown() {
+	bd.startMu.Lock()
+	bd.closing.Store(true)
+	bd.startMu.Unlock()
+	close(bd.disconnect)
+	// Let the serving loop notice the disconnection
+	bd.Resume()
+	// Once the sockets are closed, after the request in flight, which may
+	// be the caller
+	defer func() {
+		bd.wg.Add(1)
+		go func() {
+			defer bd.wg.Done()
+			bd.gate <- struct{}{}
+			bd.disconnectDriver()
+			<-bd.gate
+		}()
+	}()
+	if bd.deviceFp == nil {
+		// Served by Serve, there is only the connection to close
+		if bd.conn != nil {
+			bd.conn.Close()
+		}
+		return
+	}
+	bd.closeDevice()
 	log.Println("NBD client disconnected")
 }
 
-func readNbdRequest(buf []byte, request *nbdRequest) {
-	request.Magic = binary.BigEndian.Uint32(buf)
-	request.Type = binary.BigEndian.Uint32(buf[4:8])
-	request.Handle = binary.BigEndian.Uint64(buf[8:16])
-	request.From = binary.BigEndian.Uint64(buf[16:24])
-	request.Length = binary.BigEndian.Uint32(buf[24:28])
+// Ioctl issues an arbitrary ioctl on the device file, e.g. BLKGETSIZE64,
+// for what the package does not wrap. It is unsafe: arg is passed as is to
+// the kernel, which may write through it, and ioctls changing the state of
+// the device can break it.
+func (bd *BuseDevice) Ioctl(op, arg uintptr) error {
+	if bd.deviceFp == nil {
+		return errors.New("No device file to issue the ioctl on")
+	}
+	return ioctl(bd.deviceFp.Fd(), op, arg)
 }
 
-func writeNbdReply(reply *nbdReply) []byte {
-	buf := make([]byte, unsafe.Sizeof(*reply))
-	binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-	binary.BigEndian.PutUint32(buf[4:8], reply.Error)
-	binary.BigEndian.PutUint64(buf[8:16], reply.Handle)
-	// NOTE: a struct in go has 4 extra bytes, so we skip the last
-	return buf[0:16]
+// alignedBuffer allocates n bytes aligned in memory to align, a power of two
+func alignedBuffer(n, align int) []byte {
+	if align <= 1 {
+		return make([]byte, n)
+	}
+	buf := make([]byte, n+align-1)
+	offset := 0
+	if misalign := int(uintptr(unsafe.Pointer(unsafe.SliceData(buf))) & uintptr(align-1)); misalign != 0 {
+		offset = align - misalign
+	}
+	return buf[offset : offset+n : offset+n]
 }
 
-// Connect connects a BuseDevice to an actual device file
-// and starts handling requests. It does not return until it's done serving requests.
-func (bd *BuseDevice) Connect() error {
-	go bd.startNBDClient()
-	defer bd.Disconnect()
-	//opens the device file at least once, to make sure the partition table is updated
-	tmp, err := os.Open(bd.device)
-	if err != nil {
-		return fmt.Errorf("Cannot reach the device %s: %s", bd.device, err)
-	}
-	tmp.Close()
-	// Start handling requests
-	request := nbdRequest{}
-	reply := nbdReply{Magic: NBD_REPLY_MAGIC}
-	fp := os.NewFile(uintptr(bd.socketPair[0]), "unix")
-	// NOTE: a struct in go has 4 extra bytes...
-	buf := make([]byte, unsafe.Sizeof(request))
+// readBufferSize is the size of the buffer requests are read into
+const readBufferSize = 128 << 10
+
+// defaultMaxRequestLength is the default of Options.MaxRequestLength, above
+// the largest requests the kernel sends with the default queue limits
+const defaultMaxRequestLength = 32 << 20
+
+// serve handles the requests read from rw until the client goes away
+func (bd *BuseDevice) serve(rw io.ReadWriter) error {
+	opts := bd.options()
+	if len(opts.CPUs) > 0 {
+		unpin, err := pinThread(opts.CPUs)
+		if err != nil {
+			return err
+		}
+		defer unpin()
+	}
+	// Pipelined requests are parsed from the buffer without a read each
+	var r io.Reader = bufio.NewReaderSize(rw, readBufferSize)
+	if opts.Record != nil {
+		r = io.TeeReader(r, opts.Record)
+	}
+	fp := readWriter{r, rw}
+	pool := newBufferPool(opts.ServeOptions, bd.align)
+	maxLength := opts.MaxRequestLength
+	if maxLength == 0 {
+		maxLength = defaultMaxRequestLength
+	}
+	var idle *time.Timer
+	timeout := opts.IdleTimeout
+	if timeout > 0 {
+		idle = time.AfterFunc(timeout, func() {
+			log.Printf("No request for %s, disconnecting", timeout)
+			bd.Disconnect()
+		})
+		defer idle.Stop()
+	}
+	request := Request{}
+	reply := Reply{Magic: NBD_REPLY_MAGIC}
+	buf := make([]byte, requestSize)
 	for true {
-		if _, err := fp.Read(buf[0:28]); err != nil {
-			return fmt.Errorf("NBD client stopped: %s", err)
+		if idle != nil {
+			idle.Reset(timeout)
+		}
+		if _, err := io.ReadFull(fp, buf); err != nil {
+			if ferr := bd.failure(); ferr != nil {
+				return ferr
+			}
+			if bd.closing.Load() {
+				// The sockets were closed under the loop by Disconnect or Close
+				return nil
+			}
+			return fmt.Errorf("NBD client stopped: %w", err)
+		}
+		if idle != nil {
+			// A request lasting long is no inactivity
+			idle.Stop()
+		}
+		if err := UnmarshalRequest(buf, &request); err != nil {
+			return err
 		}
-		readNbdRequest(buf, &request)
-		fmt.Printf("DEBUG %#v\n", request)
 		if request.Magic != NBD_REQUEST_MAGIC {
 			return fmt.Errorf("Fatal error: received packet with wrong Magic number")
 		}
 		reply.Handle = request.Handle
-		chunk := make([]byte, request.Length)
+		command := request.Type & NBD_CMD_MASK_COMMAND
 		reply.Error = 0
-		// Dispatches READ, WRITE, DISC, FLUSH, TRIM to the corresponding implementation
-		if request.Type < NBD_CMD_READ || request.Type > NBD_CMD_TRIM {
-			log.Println("Received unknown request:", request.Type)
+		// Dispatches READ, WRITE, DISC, FLUSH, TRIM, WRITE_ZEROES to the corresponding implementation
+		if int(command) >= len(bd.op) || bd.op[command] == nil {
+			// The kernel still waits for a reply, the stream stays in sync
+			// as long as the command has no payload
+			log.Printf("Received unknown request %s (type:%#x)", commandName(request.Type), request.Type)
+			reply.Error = NBD_EINVAL
+			bd.sendReply(fp, &request, &reply, nil)
+			continue
+		}
+		if (command == NBD_CMD_READ || command == NBD_CMD_WRITE) && request.Length > maxLength {
+			if command == NBD_CMD_WRITE {
+				return fmt.Errorf("Fatal error: write of %d bytes, the maximum is %d", request.Length, maxLength)
+			}
+			log.Printf("Rejected read of %d bytes (offset:%d handle:%s), the maximum is %d", request.Length, request.From, bd.handle(request.Handle), maxLength)
+			reply.Error = NBD_EINVAL
+			bd.sendReply(fp, &request, &reply, nil)
+			continue
+		}
+		bd.gate <- struct{}{}
+		// The driver may be swapped while the gate is released
+		provider, _ := bd.driver.(ReadBufferProvider)
+		// Only reads and writes carry data, the length of the others can be huge
+		var chunk []byte
+		provided := false
+		if command == NBD_CMD_READ && provider != nil && request.Length > 0 {
+			// A panic leaves chunk nil, a pooled buffer is used instead
+			bd.recovering(func() error { chunk = provider.GetReadBuffer(uint64(request.Length)); return nil })()
+			if provided = uint64(len(chunk)) == uint64(request.Length); !provided && chunk != nil {
+				log.Printf("Driver provided a %d bytes buffer for a %d bytes read, ignored", len(chunk), request.Length)
+				bd.recovering(func() error { provider.PutReadBuffer(chunk); return nil })()
+			}
+		}
+		if !provided && (command == NBD_CMD_READ || command == NBD_CMD_WRITE) {
+			chunk = pool.get(int(request.Length))
+		}
+		bd.stats.inFlight.Add(1)
+		bd.progress(&request, &reply, false)
+		err := bd.op[command](bd, fp, chunk, &request, &reply)
+		if err == nil {
+			bd.progress(&request, &reply, true)
+		}
+		bd.stats.inFlight.Add(-1)
+		if provided {
+			bd.recovering(func() error { provider.PutReadBuffer(chunk); return nil })()
+		} else {
+			pool.put(chunk)
+		}
+		<-bd.gate
+		if err != nil {
+			return err
+		}
+		if err := bd.failure(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Longest path the kernel accepts, PATH_MAX including the terminating NUL
+const maxDevicePath = 4095
+
+// validateDevicePath rejects paths that cannot be a device node with a clear error
+func validateDevicePath(device string) error {
+	switch {
+	case device == "":
+		return fmt.Errorf("Invalid device path: empty, expected e.g. /dev/nbd0")
+	case len(device) > maxDevicePath:
+		return fmt.Errorf("Invalid device path: %d bytes long, the maximum is %d", len(device), maxDevicePath)
+	case strings.IndexByte(device, 0) >= 0:
+		return fmt.Errorf("Invalid device path %q: contains a NUL byte", device)
+	case !filepath.IsAbs(device):
+		return fmt.Errorf("Invalid device path %q: must be absolute, e.g. /dev/nbd0", device)
+	}
+	// A missing node is reported when opening, the module may not be loaded yet
+	if fi, err := os.Stat(device); err == nil && fi.Mode()&os.ModeDevice == 0 {
+		return fmt.Errorf("Invalid device path %q: not a device node", device)
+	}
+	return nil
+}
+
+// validateBlockSizes checks the logical and physical block sizes, physical
+// is ignored if 0
+func validateBlockSizes(logical, physical uint64) error {
+	for _, blockSize := range []uint64{logical, physical} {
+		if blockSize == 0 {
 			continue
 		}
-		if err := bd.op[request.Type](bd.driver, fp, chunk, &request, &reply); err != nil {
+		if err := checkBlockSize(blockSize); err != nil {
 			return err
 		}
 	}
+	if physical != 0 && physical < logical {
+		return fmt.Errorf("Physical block size %d is smaller than the logical one %d", physical, logical)
+	}
 	return nil
 }
 
-func CreateDevice(device string, size uint, buseDriver BuseInterface) (*BuseDevice, error) {
-	buseDevice := &BuseDevice{size: size, device: device, driver: buseDriver}
-	sockPair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+// validateSize makes sure the kernel will take the size as is instead of
+// wrapping or rounding it
+func validateSize(size, blockSize uint64) error {
+	_, blocks, err := Geometry(size, blockSize)
 	if err != nil {
-		return nil, fmt.Errorf("Call to socketpair failed: %s", err)
+		return err
 	}
-	fp, err := os.OpenFile(device, os.O_RDWR, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot open \"%s\". Make sure the `nbd' kernel module is loaded: %s", device, err)
-	}
-	buseDevice.deviceFp = fp
-	ioctl(buseDevice.deviceFp.Fd(), NBD_SET_SIZE, uintptr(size))
-	ioctl(buseDevice.deviceFp.Fd(), NBD_CLEAR_QUE, 0)
-	ioctl(buseDevice.deviceFp.Fd(), NBD_CLEAR_SOCK, 0)
-	buseDevice.socketPair = sockPair
-	buseDevice.op[NBD_CMD_READ] = opDeviceRead
-	buseDevice.op[NBD_CMD_WRITE] = opDeviceWrite
-	buseDevice.op[NBD_CMD_DISC] = opDeviceDisconnect
-	buseDevice.op[NBD_CMD_FLUSH] = opDeviceFlush
-	buseDevice.op[NBD_CMD_TRIM] = opDeviceTrim
+	if size > MaxDeviceSize {
+		return fmt.Errorf("Device size %d exceeds the maximum of %d", size, uint64(MaxDeviceSize))
+	}
+	// The size is set in blocks, 32-bit platforms keep devices over 4 GiB
+	if uint64(uintptr(blocks)) != blocks {
+		return fmt.Errorf("Device size %d is too many %d bytes blocks for the ioctl argument", size, blockSize)
+	}
+	return nil
+}
+
+// timeoutSeconds rounds a timeout up to the whole seconds of
+// NBD_SET_TIMEOUT, where 0 would mean the kernel default
+func timeoutSeconds(timeout time.Duration) uintptr {
+	return uintptr((timeout + time.Second - 1) / time.Second)
+}
+
+// deviceFlags derives the NBD_FLAG_* advertised to the kernel from the
+// options and the optional interfaces of the driver
+func deviceFlags(driver BuseInterface, opts Options) uint32 {
+	flags := uint32(NBD_FLAG_SEND_WRITE_ZEROES)
+	if f, ok := driver.(FlushReporter); !ok || f.NeedsFlush() {
+		flags |= NBD_FLAG_SEND_FLUSH
+	}
+	if t, ok := driver.(TrimReporter); !ok || t.CanTrim() {
+		flags |= NBD_FLAG_SEND_TRIM
+	}
+	if opts.Rotational {
+		flags |= NBD_FLAG_ROTATIONAL
+	}
+	if ro, ok := driver.(ReadOnlyReporter); ok && ro.ReadOnly() {
+		flags |= NBD_FLAG_READ_ONLY
+	}
+	if mc, ok := driver.(MultiConnReporter); ok && mc.MultiConn() {
+		flags |= NBD_FLAG_CAN_MULTI_CONN
+	}
+	return flags
+}
+
+// newBuseDevice sets up the request handling state, without any kernel device
+func newBuseDevice(buseDriver BuseInterface, opts Options) *BuseDevice {
+	buseDevice := &BuseDevice{driver: buseDriver}
+	buseDevice.opts.Store(&opts)
+	buseDevice.align = 1
+	if a, ok := buseDriver.(BufferAligner); ok {
+		buseDevice.align = max(a.BufferAlignment(), 1)
+	}
+	buseDevice.encoder = opts.ReplyEncoder
+	if buseDevice.encoder == nil {
+		buseDevice.encoder = SimpleReplyEncoder{}
+	}
+	buseDevice.op[NBD_CMD_READ] = (*BuseDevice).opDeviceRead
+	buseDevice.op[NBD_CMD_WRITE] = (*BuseDevice).opDeviceWrite
+	buseDevice.op[NBD_CMD_DISC] = (*BuseDevice).opDeviceDisconnect
+	buseDevice.op[NBD_CMD_FLUSH] = (*BuseDevice).opDeviceFlush
+	buseDevice.op[NBD_CMD_TRIM] = (*BuseDevice).opDeviceTrim
+	buseDevice.op[NBD_CMD_WRITE_ZEROES] = (*BuseDevice).opDeviceWriteZeroes
 	buseDevice.disconnect = make(chan int, 5)
-	return buseDevice, nil
+	buseDevice.gate = make(chan struct{}, 1)
+	buseDevice.served = make(chan struct{})
+	// Nothing tells what the driver holds before the first flush
+	buseDevice.unflushed = true
+	return buseDevice
 }
@@ -0,0 +1,118 @@
+package buse
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+)
+
+// memDevice is an in-memory driver for the benchmarks
+type memDevice struct {
+	data []byte
+}
+
+func (d *memDevice) ReadAt(p []byte, off uint64) error {
+	copy(p, d.data[off:])
+	return nil
+}
+
+func (d *memDevice) WriteAt(p []byte, off uint64) error {
+	copy(d.data[off:], p)
+	return nil
+}
+
+func (d *memDevice) Disconnect() {
+}
+
+func (d *memDevice) Flush() error {
+	return nil
+}
+
+func (d *memDevice) Trim(off, length uint64) error {
+	return nil
+}
+
+// benchClient sends requests to Serve over a pipe, as the kernel does
+type benchClient struct {
+	conn  net.Conn
+	done  chan error
+	reply []byte
+	data  []byte
+}
+
+func newBenchClient(b *testing.B, size int) *benchClient {
+	log.SetOutput(io.Discard)
+	client, server := net.Pipe()
+	c := &benchClient{
+		conn:  client,
+		done:  make(chan error, 1),
+		reply: make([]byte, replySize),
+		data:  make([]byte, size),
+	}
+	driver := &memDevice{data: make([]byte, 2<<20)}
+	go func() { c.done <- Serve(server, driver, ServeOptions{}) }()
+	b.Cleanup(func() {
+		client.Write(MarshalRequest(&Request{Magic: NBD_REQUEST_MAGIC, Type: NBD_CMD_DISC}))
+		if err := <-c.done; err != nil {
+			b.Error(err)
+		}
+		log.SetOutput(os.Stderr)
+	})
+	return c
+}
+
+// do sends a request and reads its reply
+func (c *benchClient) do(b *testing.B, command uint32, length uint32) {
+	request := MarshalRequest(&Request{Magic: NBD_REQUEST_MAGIC, Type: command, Length: length})
+	if _, err := c.conn.Write(request); err != nil {
+		b.Fatal(err)
+	}
+	if command == NBD_CMD_WRITE {
+		if _, err := c.conn.Write(c.data[:length]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := io.ReadFull(c.conn, c.reply); err != nil {
+		b.Fatal(err)
+	}
+	if command == NBD_CMD_READ {
+		if _, err := io.ReadFull(c.conn, c.data[:length]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkCommand(b *testing.B, command uint32) {
+	for _, size := range []int{512, 4 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			c := newBenchClient(b, size)
+			if command == NBD_CMD_READ || command == NBD_CMD_WRITE {
+				b.SetBytes(int64(size))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.do(b, command, uint32(size))
+			}
+		})
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkCommand(b, NBD_CMD_READ)
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkCommand(b, NBD_CMD_WRITE)
+}
+
+func BenchmarkFlush(b *testing.B) {
+	benchmarkCommand(b, NBD_CMD_FLUSH)
+}
+
+func BenchmarkTrim(b *testing.B) {
+	benchmarkCommand(b, NBD_CMD_TRIM)
+}
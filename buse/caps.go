@@ -0,0 +1,81 @@
+package buse
+
+import (
+	"strings"
+)
+
+// Caps describes what a device supports, see BuseDevice.Capabilities
+type Caps struct {
+	// Commands advertised to the kernel
+	Flush       bool
+	Trim        bool
+	WriteZeroes bool
+	// ReadOnly, Rotational and MultiConn reflect how the device is advertised
+	ReadOnly   bool
+	Rotational bool
+	MultiConn  bool
+	// Optional interfaces implemented by the driver
+	NativeZeroes   bool // WriteZeroer
+	DirtyTracking  bool // DirtyReporter
+	ZeroDetection  bool // ZeroReporter
+	DisconnectVeto bool // DisconnectVetoer
+	ConnectHook    bool // ConnectObserver
+	RangeFlush     bool // RangeFlusher
+	FreeingTrim    bool // FreeingTrimmer
+	ReadBuffers    bool // ReadBufferProvider
+}
+
+// Capabilities reports the commands enabled on the device and the
+// optional interfaces its driver implements
+func (bd *BuseDevice) Capabilities() Caps {
+	caps := Caps{
+		Flush:       bd.flags&NBD_FLAG_SEND_FLUSH != 0,
+		Trim:        bd.flags&NBD_FLAG_SEND_TRIM != 0,
+		WriteZeroes: bd.flags&NBD_FLAG_SEND_WRITE_ZEROES != 0,
+		ReadOnly:    bd.flags&NBD_FLAG_READ_ONLY != 0,
+		Rotational:  bd.flags&NBD_FLAG_ROTATIONAL != 0,
+		MultiConn:   bd.flags&NBD_FLAG_CAN_MULTI_CONN != 0,
+	}
+	driver := bd.currentDriver()
+	_, caps.NativeZeroes = driver.(WriteZeroer)
+	_, caps.DirtyTracking = driver.(DirtyReporter)
+	_, caps.ZeroDetection = driver.(ZeroReporter)
+	_, caps.DisconnectVeto = driver.(DisconnectVetoer)
+	_, caps.ConnectHook = driver.(ConnectObserver)
+	_, caps.RangeFlush = driver.(RangeFlusher)
+	_, caps.FreeingTrim = driver.(FreeingTrimmer)
+	_, caps.ReadBuffers = driver.(ReadBufferProvider)
+	return caps
+}
+
+// String lists the enabled capabilities, comma separated, in a stable order
+func (c Caps) String() string {
+	var names []string
+	for _, capability := range []struct {
+		name string
+		on   bool
+	}{
+		{"flush", c.Flush},
+		{"trim", c.Trim},
+		{"write_zeroes", c.WriteZeroes},
+		{"read_only", c.ReadOnly},
+		{"rotational", c.Rotational},
+		{"multi_conn", c.MultiConn},
+		{"native_zeroes", c.NativeZeroes},
+		{"dirty_tracking", c.DirtyTracking},
+		{"zero_detection", c.ZeroDetection},
+		{"disconnect_veto", c.DisconnectVeto},
+		{"connect_hook", c.ConnectHook},
+		{"range_flush", c.RangeFlush},
+		{"freeing_trim", c.FreeingTrim},
+		{"read_buffers", c.ReadBuffers},
+	} {
+		if capability.on {
+			names = append(names, capability.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,103 @@
+package buse
+
+import (
+	"fmt"
+)
+
+// Segment is a backend of Size bytes, part of a ConcatDevice
+type Segment struct {
+	Driver BuseInterface
+	Size   uint64
+}
+
+// ConcatDevice presents segments as a single device, one after the other
+// (linear concatenation). Requests spanning segments are split, optional
+// interfaces of the segments are hidden.
+type ConcatDevice struct {
+	segments []Segment
+	// offset of each segment in the device
+	starts []uint64
+	size   uint64
+}
+
+// NewConcatDevice concatenates the segments in order
+func NewConcatDevice(segments ...Segment) *ConcatDevice {
+	d := &ConcatDevice{segments: segments, starts: make([]uint64, len(segments))}
+	for i, s := range segments {
+		d.starts[i] = d.size
+		d.size += s.Size
+	}
+	return d
+}
+
+// Size returns the sum of the sizes of the segments
+func (d *ConcatDevice) Size() uint64 {
+	return d.size
+}
+
+// split calls fn for each part of the range falling in a segment, with the
+// offset in the segment and the position of the part in the range
+func (d *ConcatDevice) split(off, length uint64, fn func(s Segment, off, length, pos uint64) error) error {
+	if off > d.size || length > d.size-off {
+		return fmt.Errorf("Request past the end of the device (offset:%d len:%d size:%d)", off, length, d.size)
+	}
+	end := off + length
+	var pos uint64
+	for i, s := range d.segments {
+		start := d.starts[i]
+		if off >= end {
+			break
+		}
+		if off >= start+s.Size {
+			continue
+		}
+		n := min(end, start+s.Size) - off
+		if err := fn(s, off-start, n, pos); err != nil {
+			return err
+		}
+		off += n
+		pos += n
+	}
+	return nil
+}
+
+func (d *ConcatDevice) ReadAt(p []byte, off uint64) error {
+	return d.split(off, uint64(len(p)), func(s Segment, segOff, n, pos uint64) error {
+		return s.Driver.ReadAt(p[pos:pos+n], segOff)
+	})
+}
+
+func (d *ConcatDevice) WriteAt(p []byte, off uint64) error {
+	return d.split(off, uint64(len(p)), func(s Segment, segOff, n, pos uint64) error {
+		return s.Driver.WriteAt(p[pos:pos+n], segOff)
+	})
+}
+
+func (d *ConcatDevice) Trim(off, length uint64) error {
+	return d.split(off, length, func(s Segment, segOff, n, pos uint64) error {
+		return s.Driver.Trim(segOff, n)
+	})
+}
+
+func (d *ConcatDevice) WriteZeroes(off, length uint64) error {
+	return d.split(off, length, func(s Segment, segOff, n, pos uint64) error {
+		return writeZeroes(s.Driver, segOff, n)
+	})
+}
+
+// Flush flushes all the segments, even if one fails
+func (d *ConcatDevice) Flush() error {
+	var err error
+	for _, s := range d.segments {
+		if e := s.Driver.Flush(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (d *ConcatDevice) Disconnect() {
+	for _, s := range d.segments {
+		s.Driver.Disconnect()
+	}
+}
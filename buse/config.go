@@ -0,0 +1,33 @@
+package buse
+
+// DeviceConfig is the effective configuration of a device, see
+// BuseDevice.Config
+type DeviceConfig struct {
+	Device    string
+	Size      uint64
+	BlockSize uint64
+	// Flags are the NBD_FLAG_* advertised to the kernel, they derive from
+	// the options and the driver and are ignored by CreateDeviceFromConfig
+	Flags   uint32
+	Options Options
+}
+
+// Config returns the effective configuration of the device
+func (bd *BuseDevice) Config() DeviceConfig {
+	return DeviceConfig{
+		Device:    bd.device,
+		Size:      bd.size,
+		BlockSize: bd.blockSize,
+		Flags:     bd.flags,
+		Options:   *bd.options(),
+	}
+}
+
+// CreateDeviceFromConfig creates a device from a configuration, typically
+// one returned by Config. A non zero BlockSize overrides Options.BlockSize.
+func CreateDeviceFromConfig(cfg DeviceConfig, buseDriver BuseInterface) (*BuseDevice, error) {
+	if cfg.BlockSize != 0 {
+		cfg.Options.BlockSize = cfg.BlockSize
+	}
+	return CreateDeviceWithOptions(cfg.Device, cfg.Size, buseDriver, cfg.Options)
+}
@@ -0,0 +1,189 @@
+package buse
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+type dedupBlock struct {
+	data []byte
+	refs int
+}
+
+// DedupDevice is an in-memory driver storing each distinct block content
+// once, keyed by its hash, for data with many duplicate blocks like VM
+// images. Blocks never written, trimmed or zeroed take no space.
+type DedupDevice struct {
+	size      uint64
+	blockSize uint64
+	mu        sync.Mutex
+	// hash of the content of each mapped block
+	index    map[uint64][sha256.Size]byte
+	blocks   map[[sha256.Size]byte]*dedupBlock
+	zero     []byte
+	zeroHash [sha256.Size]byte
+}
+
+// NewDedupDevice creates a device of size bytes deduplicated by blocks of
+// blockSize bytes, which must not be 0
+func NewDedupDevice(size, blockSize uint64) (*DedupDevice, error) {
+	if blockSize == 0 {
+		return nil, fmt.Errorf("Invalid dedup block size: %d", blockSize)
+	}
+	zero := make([]byte, blockSize)
+	return &DedupDevice{
+		size:      size,
+		blockSize: blockSize,
+		index:     make(map[uint64][sha256.Size]byte),
+		blocks:    make(map[[sha256.Size]byte]*dedupBlock),
+		zero:      zero,
+		zeroHash:  sha256.Sum256(zero),
+	}, nil
+}
+
+// Size returns the size of the device
+func (d *DedupDevice) Size() uint64 {
+	return d.size
+}
+
+// UniqueBlocks returns the number of distinct blocks stored
+func (d *DedupDevice) UniqueBlocks() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.blocks)
+}
+
+func (d *DedupDevice) check(off, length uint64) error {
+	if off > d.size || length > d.size-off {
+		return fmt.Errorf("Request past the end of the device (offset:%d len:%d size:%d)", off, length, d.size)
+	}
+	return nil
+}
+
+// block returns the content of a block, it must not be modified
+func (d *DedupDevice) block(index uint64) []byte {
+	if hash, ok := d.index[index]; ok {
+		return d.blocks[hash].data
+	}
+	return d.zero
+}
+
+// unmap drops the reference of a block to its content
+func (d *DedupDevice) unmap(index uint64) {
+	hash, ok := d.index[index]
+	if !ok {
+		return
+	}
+	delete(d.index, index)
+	if b := d.blocks[hash]; b.refs > 1 {
+		b.refs--
+	} else {
+		delete(d.blocks, hash)
+	}
+}
+
+// store maps a block to data, which is copied
+func (d *DedupDevice) store(index uint64, data []byte) {
+	hash := sha256.Sum256(data)
+	if old, ok := d.index[index]; ok && old == hash {
+		return
+	}
+	d.unmap(index)
+	if hash == d.zeroHash {
+		return
+	}
+	if b, ok := d.blocks[hash]; ok {
+		b.refs++
+	} else {
+		d.blocks[hash] = &dedupBlock{data: append([]byte(nil), data...), refs: 1}
+	}
+	d.index[index] = hash
+}
+
+func (d *DedupDevice) ReadAt(p []byte, off uint64) error {
+	if err := d.check(off, uint64(len(p))); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for n := uint64(0); n < uint64(len(p)); {
+		index, inBlock := (off+n)/d.blockSize, (off+n)%d.blockSize
+		n += uint64(copy(p[n:], d.block(index)[inBlock:]))
+	}
+	return nil
+}
+
+func (d *DedupDevice) WriteAt(p []byte, off uint64) error {
+	if err := d.check(off, uint64(len(p))); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	buf := make([]byte, d.blockSize)
+	for n := uint64(0); n < uint64(len(p)); {
+		index, inBlock := (off+n)/d.blockSize, (off+n)%d.blockSize
+		data := p[n:]
+		if inBlock != 0 || uint64(len(data)) < d.blockSize {
+			// Partial block, patch its current content
+			copy(buf, d.block(index))
+			copy(buf[inBlock:], data)
+			data = buf
+		}
+		d.store(index, data[:d.blockSize])
+		n += d.blockSize - inBlock
+	}
+	return nil
+}
+
+// Trim frees the whole blocks of the range and zeroes the partial ones
+func (d *DedupDevice) Trim(off, length uint64) error {
+	return d.WriteZeroes(off, length)
+}
+
+func (d *DedupDevice) WriteZeroes(off, length uint64) error {
+	if err := d.check(off, length); err != nil {
+		return err
+	}
+	start := (off + d.blockSize - 1) / d.blockSize * d.blockSize
+	end := (off + length) / d.blockSize * d.blockSize
+	if end <= start {
+		return d.WriteAt(make([]byte, length), off)
+	}
+	if start > off {
+		if err := d.WriteAt(make([]byte, start-off), off); err != nil {
+			return err
+		}
+	}
+	d.mu.Lock()
+	first, last := start/d.blockSize, end/d.blockSize
+	if last-first > uint64(len(d.index)) {
+		// Cheaper to look for the mapped blocks of a large range
+		for index := range d.index {
+			if index >= first && index < last {
+				d.unmap(index)
+			}
+		}
+	} else {
+		for index := first; index < last; index++ {
+			d.unmap(index)
+		}
+	}
+	d.mu.Unlock()
+	if off+length > end {
+		return d.WriteAt(make([]byte, off+length-end), end)
+	}
+	return nil
+}
+
+func (d *DedupDevice) Flush() error {
+	return nil
+}
+
+// NeedsFlush is false, the blocks only live in memory
+func (d *DedupDevice) NeedsFlush() bool {
+	return false
+}
+
+func (d *DedupDevice) Disconnect() {
+}
@@ -0,0 +1,249 @@
+//go:build linux
+
+package buse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+func ioctl(fd, op, arg uintptr) error {
+	_, _, ep := syscall.Syscall(syscall.SYS_IOCTL, fd, op, arg)
+	if ep != 0 {
+		return fmt.Errorf("ioctl(%d, %d, %d) failed: %w", fd, op, arg, syscall.Errno(ep))
+	}
+	return nil
+}
+
+func (bd *BuseDevice) startNBDClient() {
+	defer bd.wg.Done()
+	bd.startMu.Lock()
+	if bd.closing.Load() {
+		// Torn down before the kernel got the socket, which is closed by now
+		bd.startMu.Unlock()
+		return
+	}
+	err := ioctl(bd.deviceFp.Fd(), NBD_SET_SOCK, uintptr(bd.socketPair[1]))
+	bd.startMu.Unlock()
+	if err != nil {
+		bd.fail(err)
+		return
+	}
+	// The call below may fail on some systems (if flags unset), could be ignored
+	if err := ioctl(bd.deviceFp.Fd(), NBD_SET_FLAGS, uintptr(bd.flags)); err != nil {
+		log.Println("Cannot set the device flags:", err)
+	}
+	log.Printf("NBD device=%s size=%d block_size=%d flags=0x%x caps=%s",
+		bd.device, bd.size, bd.blockSize, bd.flags, bd.Capabilities())
+	// The following call will block until the client disconnects
+	log.Println("Starting NBD client...")
+	bd.wg.Add(1)
+	go func() {
+		defer bd.wg.Done()
+		err := ioctl(bd.deviceFp.Fd(), NBD_DO_IT, 0)
+		bd.doItErr <- err
+		if err != nil && !bd.closing.Load() && !errors.Is(err, syscall.ETIMEDOUT) {
+			bd.fail(err)
+		}
+	}()
+	// Block on the disconnect channel
+	<-bd.disconnect
+}
+
+// closeDevice releases the kernel device and the sockets, errors included
+func (bd *BuseDevice) closeDevice() {
+	// Ok to fail, the clearing errors are only kept for DisconnectErr
+	clearQueErr := ioctl(bd.deviceFp.Fd(), NBD_CLEAR_QUE, 0)
+	syscall.Syscall(syscall.SYS_IOCTL, bd.deviceFp.Fd(), NBD_DISCONNECT, 0)
+	clearSockErr := ioctl(bd.deviceFp.Fd(), NBD_CLEAR_SOCK, 0)
+	bd.clearErr = errors.Join(clearQueErr, clearSockErr)
+	// Cleanup fd
+	// Through the File, whose finalizer would close the fd number again
+	bd.sock.Close()
+	syscall.Close(bd.socketPair[1])
+	bd.closeErr = bd.deviceFp.Close()
+}
+
+// How often Connect checks that the device file still exists
+const deviceWatchInterval = time.Second
+
+// watchDevice tears the device down once its file disappears, e.g. with
+// udev churn, rather than letting the later ioctls fail obscurely
+func (bd *BuseDevice) watchDevice() {
+	defer bd.wg.Done()
+	ticker := time.NewTicker(deviceWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bd.disconnect:
+			return
+		case <-ticker.C:
+			if _, err := os.Stat(bd.device); os.IsNotExist(err) {
+				bd.fail(ErrDeviceRemoved)
+				return
+			}
+		}
+	}
+}
+
+// How long rescanPartitions waits for the kernel to report the size
+const partitionScanTimeout = 5 * time.Second
+
+// rescanPartitions re-reads the partition table once the device is up, that
+// is when the kernel reports its size
+func (bd *BuseDevice) rescanPartitions() {
+	defer bd.wg.Done()
+	deadline := time.Now().Add(partitionScanTimeout)
+	for {
+		if size, err := bd.KernelSize(); err == nil && size > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Println("The device did not come up, no partition table re-read")
+			return
+		}
+		select {
+		case <-bd.disconnect:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if err := ioctl(bd.deviceFp.Fd(), BLKRRPART, 0); err != nil && !bd.closing.Load() {
+		log.Println("Cannot re-read the partition table:", err)
+	}
+}
+
+// How long Connect waits for NBD_DO_IT to tell why the connection dropped
+const doItWait = time.Second
+
+// Connect connects a BuseDevice to an actual device file
+// and starts handling requests. It does not return until it's done serving requests.
+// It returns nil once disconnected by Disconnect or Close, right away if
+// they came first, ErrDeviceRemoved when disconnected from outside the
+// process, e.g. by nbd-client -d, and an error wrapping syscall.ETIMEDOUT
+// when the kernel dropped the connection after Options.Timeout.
+func (bd *BuseDevice) Connect() error {
+	if bd.closing.Load() {
+		// Disconnected or closed before connecting, e.g. by a cancelled Run
+		return nil
+	}
+	bd.connected.Store(true)
+	bd.wg.Add(1)
+	go bd.startNBDClient()
+	defer bd.shutdown()
+	defer close(bd.served)
+	// Before the partition scan, which may read through the driver
+	if c, ok := bd.currentDriver().(ConnectObserver); ok {
+		if err := bd.recovering(c.OnConnect)(); err != nil {
+			return fmt.Errorf("Driver refused the connection: %w", err)
+		}
+	}
+	if !bd.options().SkipPartitionScan {
+		// The re-read issues requests, it must run while they are served
+		bd.wg.Add(1)
+		go bd.rescanPartitions()
+	}
+	bd.wg.Add(1)
+	go bd.watchDevice()
+	err := bd.serve(bd.sock)
+	if err == errDisconnect {
+		// NBD_CMD_DISC has no reply, the socket is done with
+		if bd.disconnecting.Load() || bd.closing.Load() {
+			return nil
+		}
+		return ErrDeviceRemoved
+	}
+	if errors.Is(err, io.EOF) && !bd.closing.Load() {
+		// The kernel tells a timeout of its own by the result of NBD_DO_IT
+		select {
+		case doItErr := <-bd.doItErr:
+			if errors.Is(doItErr, syscall.ETIMEDOUT) {
+				return fmt.Errorf("The kernel timed out a request of %s: %w", bd.device, doItErr)
+			}
+		case <-time.After(doItWait):
+		}
+		if bd.removed() {
+			return ErrDeviceRemoved
+		}
+	}
+	return err
+}
+
+// CreateDevice sets up the NBD device file to be served by buseDriver.
+// The size is given in bytes, a multiple of the block size, and its number
+// of blocks must fit the ioctl argument of the platform.
+func CreateDevice(device string, size uint64, buseDriver BuseInterface) (*BuseDevice, error) {
+	return CreateDeviceWithOptions(device, size, buseDriver, Options{})
+}
+
+// CreateDeviceWithOptions is like CreateDevice but lets the caller tune the device.
+func CreateDeviceWithOptions(device string, size uint64, buseDriver BuseInterface, opts Options) (_ *BuseDevice, err error) {
+	if err := validateDevicePath(device); err != nil {
+		return nil, err
+	}
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+	if err := validateBlockSizes(blockSize, opts.PhysicalBlockSize); err != nil {
+		return nil, err
+	}
+	if err := validateSize(size, blockSize); err != nil {
+		return nil, err
+	}
+	if !hasSysAdmin() {
+		return nil, ErrInsufficientPrivilege
+	}
+	buseDevice := newBuseDevice(buseDriver, opts)
+	buseDevice.size = size
+	buseDevice.blockSize = blockSize
+	buseDevice.device = device
+	buseDevice.flags = deviceFlags(buseDriver, opts)
+	buseDevice.doItErr = make(chan error, 1)
+	sockPair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Call to socketpair failed: %s", err)
+	}
+	// Do not leak the sockets nor the device when a later step fails
+	defer func() {
+		if err != nil {
+			syscall.Close(sockPair[0])
+			syscall.Close(sockPair[1])
+			if buseDevice.deviceFp != nil {
+				buseDevice.deviceFp.Close()
+			}
+		}
+	}()
+	fp, err := openDevice(device, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open \"%s\". Make sure the `nbd' kernel module is loaded: %s", device, err)
+	}
+	buseDevice.deviceFp = fp
+	// The size is given in blocks, so that it fits the ioctl argument of
+	// 32-bit platforms too, the block size must be set first
+	if err := ioctl(buseDevice.deviceFp.Fd(), NBD_SET_BLKSIZE, uintptr(blockSize)); err != nil {
+		return nil, fmt.Errorf("Cannot set the block size of %s: %s", device, err)
+	}
+	if err := ioctl(buseDevice.deviceFp.Fd(), NBD_SET_SIZE_BLOCKS, uintptr(size/blockSize)); err != nil {
+		return nil, fmt.Errorf("Cannot set the size of %s: %s", device, err)
+	}
+	if opts.Timeout > 0 {
+		if err := ioctl(buseDevice.deviceFp.Fd(), NBD_SET_TIMEOUT, timeoutSeconds(opts.Timeout)); err != nil {
+			return nil, fmt.Errorf("Cannot set the timeout of %s: %s", device, err)
+		}
+	}
+	if err := ioctl(buseDevice.deviceFp.Fd(), NBD_CLEAR_QUE, 0); err != nil {
+		return nil, fmt.Errorf("Cannot clear the queue of %s: %s", device, err)
+	}
+	if err := ioctl(buseDevice.deviceFp.Fd(), NBD_CLEAR_SOCK, 0); err != nil {
+		return nil, fmt.Errorf("Cannot clear the socket of %s: %s", device, err)
+	}
+	buseDevice.socketPair = sockPair
+	buseDevice.sock = os.NewFile(uintptr(sockPair[0]), "unix")
+	return buseDevice, nil
+}
@@ -0,0 +1,44 @@
+//go:build !linux
+
+package buse
+
+import (
+	"context"
+	"fmt"
+)
+
+// ioctl fails: the nbd devices need the ioctls of Linux, elsewhere the
+// functions below fail with ErrUnsupportedPlatform so that the rest of the
+// package still builds. Serve is the way to use a driver there.
+func ioctl(fd, op, arg uintptr) error {
+	return ErrUnsupportedPlatform
+}
+
+// closeDevice is never called, no device can be created
+func (bd *BuseDevice) closeDevice() {
+}
+
+// pinThread cannot restrict the affinity of a thread
+func pinThread(cpus []int) (func(), error) {
+	return nil, fmt.Errorf("Cannot pin the serving loop to CPUs: %w", ErrUnsupportedPlatform)
+}
+
+// CreateDevice fails with ErrUnsupportedPlatform
+func CreateDevice(device string, size uint64, buseDriver BuseInterface) (*BuseDevice, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// CreateDeviceWithOptions fails with ErrUnsupportedPlatform
+func CreateDeviceWithOptions(device string, size uint64, buseDriver BuseInterface, opts Options) (*BuseDevice, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// Connect fails with ErrUnsupportedPlatform
+func (bd *BuseDevice) Connect() error {
+	return ErrUnsupportedPlatform
+}
+
+// SelfTest fails with ErrUnsupportedPlatform
+func (bd *BuseDevice) SelfTest(ctx context.Context) error {
+	return ErrUnsupportedPlatform
+}
@@ -0,0 +1,30 @@
+package buse
+
+import (
+	"fmt"
+	"io"
+)
+
+// ReplyEncoder writes the reply to a request, followed by its data if any.
+// It lets newer reply formats (e.g. structured replies) be plugged in.
+type ReplyEncoder interface {
+	WriteReply(w io.Writer, handle uint64, errno uint32, data []byte) error
+}
+
+// SimpleReplyEncoder writes classic NBD simple replies: the 16 bytes
+// reply header followed by the data as is.
+type SimpleReplyEncoder struct{}
+
+func (SimpleReplyEncoder) WriteReply(w io.Writer, handle uint64, errno uint32, data []byte) error {
+	buf := MarshalReply(&Reply{Magic: NBD_REPLY_MAGIC, Error: errno, Handle: handle})
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("cannot send reply header: %s", err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("cannot send data chunk: %s", err)
+	}
+	return nil
+}
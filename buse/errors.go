@@ -0,0 +1,35 @@
+package buse
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Errors with a matching NBD error code, any other error is replied as EPERM
+var errorCodes = []struct {
+	err  error
+	code uint32
+}{
+	{ErrNotSupported, NBD_ENOTSUP},
+	{ErrMirrorMismatch, NBD_EIO},
+	{ErrUnavailable, NBD_EIO},
+	{syscall.EPERM, NBD_EPERM},
+	{syscall.EROFS, NBD_EPERM},
+	{syscall.EIO, NBD_EIO},
+	{syscall.ENOMEM, NBD_ENOMEM},
+	{syscall.EINVAL, NBD_EINVAL},
+	{syscall.ENOSPC, NBD_ENOSPC},
+	{syscall.EOVERFLOW, NBD_EOVERFLOW},
+	{syscall.EOPNOTSUPP, NBD_ENOTSUP},
+	{syscall.ESHUTDOWN, NBD_ESHUTDOWN},
+}
+
+// errorCode maps a driver error to the error code of the reply
+func errorCode(err error) uint32 {
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return NBD_EPERM
+}
@@ -0,0 +1,92 @@
+package buse
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"syscall"
+)
+
+// FaultPolicy selects which operations a FaultInjector fails. An operation
+// fails when any of the criteria matches.
+type FaultPolicy struct {
+	// EveryNth fails every Nth operation, disabled if 0
+	EveryNth int
+	// Ranges fails the operations touching any of the extents
+	Ranges []Extent
+	// Probability fails operations at random, drawn from a source seeded
+	// with Seed so that a run can be reproduced
+	Probability float64
+	Seed        int64
+	// Errno is the error returned by failed operations, EIO if 0
+	Errno syscall.Errno
+	// ReadsOnly and WritesOnly restrict the policy to reads or writes
+	ReadsOnly  bool
+	WritesOnly bool
+}
+
+// FaultInjector wraps a driver to fail its reads and writes according to a
+// policy, to test how the upper layers behave under I/O errors.
+type FaultInjector struct {
+	BuseInterface
+	policy FaultPolicy
+	mu     sync.Mutex
+	rand   *rand.Rand
+	ops    int
+	faults int
+}
+
+// NewFaultInjector wraps the inner driver
+func NewFaultInjector(inner BuseInterface, policy FaultPolicy) *FaultInjector {
+	if policy.Errno == 0 {
+		policy.Errno = syscall.EIO
+	}
+	return &FaultInjector{
+		BuseInterface: inner,
+		policy:        policy,
+		rand:          rand.New(rand.NewSource(policy.Seed)),
+	}
+}
+
+func (f *FaultInjector) ReadAt(p []byte, off uint64) error {
+	if err := f.inject(false, off, uint64(len(p))); err != nil {
+		return err
+	}
+	return f.BuseInterface.ReadAt(p, off)
+}
+
+func (f *FaultInjector) WriteAt(p []byte, off uint64) error {
+	if err := f.inject(true, off, uint64(len(p))); err != nil {
+		return err
+	}
+	return f.BuseInterface.WriteAt(p, off)
+}
+
+// Faults returns how many operations were failed so far
+func (f *FaultInjector) Faults() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.faults
+}
+
+func (f *FaultInjector) inject(write bool, off, length uint64) error {
+	if (write && f.policy.ReadsOnly) || (!write && f.policy.WritesOnly) {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops++
+	fail := f.policy.EveryNth > 0 && f.ops%f.policy.EveryNth == 0
+	for _, r := range f.policy.Ranges {
+		fail = fail || r.Overlaps(off, length)
+	}
+	// Always draw, so that the sequence only depends on the seed and the operations
+	if f.rand.Float64() < f.policy.Probability {
+		fail = true
+	}
+	if !fail {
+		return nil
+	}
+	f.faults++
+	return fmt.Errorf("injected fault (offset:%d len:%d): %w", off, length, f.policy.Errno)
+}
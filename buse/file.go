@@ -0,0 +1,103 @@
+package buse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"unsafe"
+)
+
+// ErrMisaligned is returned for I/O on a direct FileDevice that is not aligned
+var ErrMisaligned = errors.New("misaligned I/O on a direct file")
+
+// Alignment of offsets, lengths and buffers for O_DIRECT, safe for all backing filesystems
+const directAlignment = 4096
+
+// FileDevice is a driver backed by a file, or a block device
+type FileDevice struct {
+	fp     *os.File
+	size   uint64
+	direct bool
+}
+
+// OpenFileDevice opens the backing file at path. With direct, it is opened
+// with O_DIRECT so the data is not cached twice: the kernel already caches
+// the nbd device. Offsets, lengths and buffers must then be aligned to 4096
+// bytes, or ErrMisaligned is returned.
+func OpenFileDevice(path string, direct bool) (*FileDevice, error) {
+	fp, err := openFile(path, direct)
+	if err != nil {
+		return nil, err
+	}
+	size, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return &FileDevice{fp: fp, size: uint64(size), direct: direct}, nil
+}
+
+// Size returns the size of the backing file when it was opened
+func (d *FileDevice) Size() uint64 {
+	return d.size
+}
+
+// BufferAlignment asks for buffers suitable for O_DIRECT when direct
+func (d *FileDevice) BufferAlignment() int {
+	if d.direct {
+		return directAlignment
+	}
+	return 1
+}
+
+func (d *FileDevice) checkIO(p []byte, off uint64) error {
+	if off > math.MaxInt64-uint64(len(p)) {
+		return fmt.Errorf("Offset %d out of range", off)
+	}
+	if !d.direct || len(p) == 0 {
+		return nil
+	}
+	if off%directAlignment != 0 || len(p)%directAlignment != 0 ||
+		uintptr(unsafe.Pointer(&p[0]))%directAlignment != 0 {
+		return fmt.Errorf("%w (offset:%d len:%d)", ErrMisaligned, off, len(p))
+	}
+	return nil
+}
+
+func (d *FileDevice) ReadAt(p []byte, off uint64) error {
+	if err := d.checkIO(p, off); err != nil {
+		return err
+	}
+	n, err := d.fp.ReadAt(p, int64(off))
+	if err == io.EOF && n == len(p) {
+		return nil
+	}
+	return err
+}
+
+func (d *FileDevice) WriteAt(p []byte, off uint64) error {
+	if err := d.checkIO(p, off); err != nil {
+		return err
+	}
+	_, err := d.fp.WriteAt(p, int64(off))
+	return err
+}
+
+func (d *FileDevice) Flush() error {
+	return d.fp.Sync()
+}
+
+// Trim punches a hole in the backing file, a no-op where not supported
+func (d *FileDevice) Trim(off, length uint64) error {
+	if off > math.MaxInt64-length {
+		return fmt.Errorf("Offset %d out of range", off)
+	}
+	return punchHole(d.fp, int64(off), int64(length))
+}
+
+// Disconnect closes the backing file
+func (d *FileDevice) Disconnect() {
+	d.fp.Close()
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package buse
+
+import (
+	"os"
+	"syscall"
+)
+
+// Flags of fallocate(2) to discard a range
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// openFile opens a backing file, bypassing the page cache with direct
+func openFile(path string, direct bool) (*os.File, error) {
+	flags := os.O_RDWR
+	if direct {
+		flags |= syscall.O_DIRECT
+	}
+	return os.OpenFile(path, flags, 0600)
+}
+
+// punchHole discards a range of the file, a no-op where not supported
+func punchHole(fp *os.File, off, length int64) error {
+	err := syscall.Fallocate(int(fp.Fd()), fallocPunchHole|fallocKeepSize, off, length)
+	if err == syscall.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
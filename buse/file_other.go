@@ -0,0 +1,21 @@
+//go:build !linux
+
+package buse
+
+import (
+	"fmt"
+	"os"
+)
+
+// openFile opens a backing file, direct I/O needs Linux
+func openFile(path string, direct bool) (*os.File, error) {
+	if direct {
+		return nil, fmt.Errorf("Cannot open %s for direct I/O: %w", path, ErrUnsupportedPlatform)
+	}
+	return os.OpenFile(path, os.O_RDWR, 0600)
+}
+
+// punchHole is a no-op, discarding needs Linux
+func punchHole(fp *os.File, off, length int64) error {
+	return nil
+}
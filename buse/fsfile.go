@@ -0,0 +1,91 @@
+package buse
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// FSFileDevice is a read-only driver serving a file of an fs.FS, e.g. an
+// embedded or archive filesystem
+type FSFileDevice struct {
+	file fs.File
+	r    io.ReaderAt
+	size uint64
+}
+
+// NewFSFileDevice opens name in fsys to export it read-only. The file must
+// support random access, i.e. implement io.ReaderAt.
+func NewFSFileDevice(fsys fs.FS, name string) (*FSFileDevice, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("Cannot serve %s: the file does not support random access", name)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("Cannot serve %s: not a regular file", name)
+	}
+	return &FSFileDevice{file: f, r: r, size: uint64(fi.Size())}, nil
+}
+
+// Size returns the size of the file
+func (d *FSFileDevice) Size() uint64 {
+	return d.size
+}
+
+func (d *FSFileDevice) ReadAt(p []byte, off uint64) error {
+	if off > d.size || uint64(len(p)) > d.size-off {
+		return fmt.Errorf("Read past the end of the file (offset:%d len:%d size:%d)", off, len(p), d.size)
+	}
+	n, err := d.r.ReadAt(p, int64(off))
+	// The read may end exactly at the end of the file
+	if err == io.EOF {
+		if n == len(p) {
+			return nil
+		}
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *FSFileDevice) WriteAt(p []byte, off uint64) error {
+	return ErrReadOnly
+}
+
+func (d *FSFileDevice) Trim(off, length uint64) error {
+	return ErrReadOnly
+}
+
+func (d *FSFileDevice) Flush() error {
+	return nil
+}
+
+// NeedsFlush is false, there is nothing to flush
+func (d *FSFileDevice) NeedsFlush() bool {
+	return false
+}
+
+// CanTrim is false, the device is read-only
+func (d *FSFileDevice) CanTrim() bool {
+	return false
+}
+
+// ReadOnly makes the device be advertised read-only to the kernel
+func (d *FSFileDevice) ReadOnly() bool {
+	return true
+}
+
+// Disconnect closes the file, reads fail afterwards
+func (d *FSFileDevice) Disconnect() {
+	d.file.Close()
+}
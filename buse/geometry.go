@@ -0,0 +1,30 @@
+package buse
+
+import (
+	"fmt"
+	"os"
+)
+
+// The kernel counts sizes in 512 bytes sectors
+const sectorSize = 512
+
+// checkBlockSize makes sure the kernel accepts a block size
+func checkBlockSize(blockSize uint64) error {
+	if blockSize < sectorSize || blockSize > uint64(os.Getpagesize()) || blockSize&(blockSize-1) != 0 {
+		return fmt.Errorf("Invalid block size %d: must be a power of two between %d and %d", blockSize, sectorSize, os.Getpagesize())
+	}
+	return nil
+}
+
+// Geometry computes the number of 512 bytes sectors and of blocks of a device
+// of sizeBytes, as fed to the size ioctls. The block size must be a power of
+// two between 512 and the page size, and divide the size.
+func Geometry(sizeBytes, blockSize uint64) (sectors, blocks uint64, err error) {
+	if err := checkBlockSize(blockSize); err != nil {
+		return 0, 0, err
+	}
+	if sizeBytes == 0 || sizeBytes%blockSize != 0 {
+		return 0, 0, fmt.Errorf("Invalid device size %d: must be a non zero multiple of the %d bytes block size", sizeBytes, blockSize)
+	}
+	return sizeBytes / sectorSize, sizeBytes / blockSize, nil
+}
@@ -0,0 +1,149 @@
+package buse
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// Magic numbers of the journal records
+const (
+	journalWriteMagic  = 0x4a524e57
+	journalZeroesMagic = 0x4a524e5a
+	// magic, crc, offset and length
+	journalHeaderSize = 20
+)
+
+// Journal stores the intent log of a JournaledDevice, *os.File implements it
+type Journal interface {
+	io.ReadWriteSeeker
+	Truncate(size int64) error
+	Sync() error
+}
+
+// JournaledDevice wraps a driver without crash consistency of its own:
+// every write is recorded and synced to the journal before reaching the
+// inner driver, and the journal is truncated once a flush made the writes
+// durable. Run Recover before serving to replay what a crash left behind.
+// Optional interfaces of the inner driver are hidden.
+type JournaledDevice struct {
+	BuseInterface
+	journal Journal
+	mu      sync.Mutex
+}
+
+// NewJournaledDevice wraps the inner driver, journaling its writes to journal
+func NewJournaledDevice(inner BuseInterface, journal Journal) *JournaledDevice {
+	return &JournaledDevice{BuseInterface: inner, journal: journal}
+}
+
+// Recover replays the writes journaled since the last flush, in order, then
+// flushes the inner driver and empties the journal. A torn record at the
+// end was never acknowledged, it is dropped.
+func (d *JournaledDevice) Recover() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := make([]byte, journalHeaderSize)
+	for {
+		if _, err := io.ReadFull(d.journal, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return err
+		}
+		magic := binary.BigEndian.Uint32(header[0:4])
+		crc := binary.BigEndian.Uint32(header[4:8])
+		off := binary.BigEndian.Uint64(header[8:16])
+		length := uint64(binary.BigEndian.Uint32(header[16:20]))
+		if magic == journalZeroesMagic {
+			if crc != crc32.ChecksumIEEE(header[8:]) {
+				break
+			}
+			if err := writeZeroes(d.BuseInterface, off, length); err != nil {
+				return err
+			}
+			continue
+		}
+		if magic != journalWriteMagic {
+			break
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(d.journal, data); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return err
+		}
+		if crc != crc32.Update(crc32.ChecksumIEEE(header[8:]), crc32.IEEETable, data) {
+			break
+		}
+		if err := d.BuseInterface.WriteAt(data, off); err != nil {
+			return err
+		}
+	}
+	return d.checkpoint()
+}
+
+// checkpoint flushes the inner driver and empties the journal
+func (d *JournaledDevice) checkpoint() error {
+	if err := d.BuseInterface.Flush(); err != nil {
+		return err
+	}
+	if err := d.journal.Truncate(0); err != nil {
+		return err
+	}
+	_, err := d.journal.Seek(0, io.SeekStart)
+	return err
+}
+
+// record appends a record to the journal and syncs it
+func (d *JournaledDevice) record(magic uint32, off, length uint64, data []byte) error {
+	buf := make([]byte, journalHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], magic)
+	binary.BigEndian.PutUint64(buf[8:16], off)
+	binary.BigEndian.PutUint32(buf[16:20], uint32(length))
+	copy(buf[journalHeaderSize:], data)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(buf[8:]))
+	if _, err := d.journal.Write(buf); err != nil {
+		return err
+	}
+	return d.journal.Sync()
+}
+
+func (d *JournaledDevice) WriteAt(p []byte, off uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.record(journalWriteMagic, off, uint64(len(p)), p); err != nil {
+		return err
+	}
+	return d.BuseInterface.WriteAt(p, off)
+}
+
+func (d *JournaledDevice) WriteZeroes(off, length uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// A record only holds a 32 bits length, like the requests
+	for length > 0 {
+		n := min(length, 1<<31)
+		if err := d.record(journalZeroesMagic, off, n, nil); err != nil {
+			return err
+		}
+		if err := writeZeroes(d.BuseInterface, off, n); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+func (d *JournaledDevice) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.checkpoint()
+}
@@ -0,0 +1,155 @@
+package buse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ErrMirrorMismatch is returned by a verifying MirroredDevice when both
+// mirrors return different data
+var ErrMirrorMismatch = errors.New("mirrors mismatch")
+
+// MirrorPolicy tunes a MirroredDevice
+type MirrorPolicy struct {
+	// Quorum is the number of mirrors a write must succeed on, both if 0.
+	// With a quorum of 1 the device keeps working with a failed mirror,
+	// which is then degraded: it misses writes, so it neither serves reads
+	// nor gets written until Rejoin.
+	Quorum int
+	// Verify reads both mirrors and fails reads returning different data,
+	// the primary data is returned unverified when the secondary fails
+	Verify bool
+}
+
+// MirroredDevice keeps two copies of the data (RAID1): the operations
+// modifying data go to both mirrors and reads are served by the primary,
+// failing over to the secondary. Optional interfaces of the mirrors are
+// hidden.
+type MirroredDevice struct {
+	mirrors  [2]BuseInterface
+	policy   MirrorPolicy
+	mu       sync.Mutex
+	degraded [2]bool
+}
+
+// NewMirroredDevice mirrors primary to secondary
+func NewMirroredDevice(primary, secondary BuseInterface, policy MirrorPolicy) *MirroredDevice {
+	if policy.Quorum <= 0 || policy.Quorum > 2 {
+		policy.Quorum = 2
+	}
+	return &MirroredDevice{mirrors: [2]BuseInterface{primary, secondary}, policy: policy}
+}
+
+// Degraded tells whether a mirror, 0 for the primary and 1 for the
+// secondary, missed writes
+func (d *MirroredDevice) Degraded(mirror int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.degraded[mirror]
+}
+
+// Rejoin puts a degraded mirror back in use, once the caller copied the
+// data of the other one to it
+func (d *MirroredDevice) Rejoin(mirror int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.degraded[mirror] = false
+}
+
+// fanOut runs op on the mirrors not degraded, it fails when less than the
+// quorum succeed. Otherwise the mirrors that failed are degraded.
+func (d *MirroredDevice) fanOut(name string, op func(mirror BuseInterface) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var firstErr error
+	var failed [2]bool
+	succeeded := 0
+	for i, mirror := range d.mirrors {
+		if d.degraded[i] {
+			continue
+		}
+		if err := op(mirror); err != nil {
+			log.Printf("Mirror %d failed to %s: %s", i, name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed[i] = true
+			continue
+		}
+		succeeded++
+	}
+	if succeeded < d.policy.Quorum {
+		return firstErr
+	}
+	for i := range failed {
+		if failed[i] {
+			log.Printf("Mirror %d degraded, it missed a %s", i, name)
+			d.degraded[i] = true
+		}
+	}
+	return nil
+}
+
+func (d *MirroredDevice) ReadAt(p []byte, off uint64) error {
+	d.mu.Lock()
+	degraded := d.degraded
+	d.mu.Unlock()
+	if degraded[0] {
+		// Only the mirror up to date has the data, no failing over
+		return d.mirrors[1].ReadAt(p, off)
+	}
+	if degraded[1] {
+		return d.mirrors[0].ReadAt(p, off)
+	}
+	err := d.mirrors[0].ReadAt(p, off)
+	if err != nil {
+		log.Printf("Primary mirror failed to read, failing over: %s", err)
+		return d.mirrors[1].ReadAt(p, off)
+	}
+	if !d.policy.Verify {
+		return nil
+	}
+	buf := make([]byte, len(p))
+	if err := d.mirrors[1].ReadAt(buf, off); err != nil {
+		// The primary served the data, there is just nothing to verify it against
+		log.Printf("Secondary mirror failed to read, not verified (offset:%d len:%d): %s", off, len(p), err)
+		return nil
+	}
+	if !bytes.Equal(p, buf) {
+		return fmt.Errorf("%w (offset:%d len:%d)", ErrMirrorMismatch, off, len(p))
+	}
+	return nil
+}
+
+func (d *MirroredDevice) WriteAt(p []byte, off uint64) error {
+	return d.fanOut("write", func(mirror BuseInterface) error {
+		return mirror.WriteAt(p, off)
+	})
+}
+
+func (d *MirroredDevice) Trim(off, length uint64) error {
+	return d.fanOut("trim", func(mirror BuseInterface) error {
+		return mirror.Trim(off, length)
+	})
+}
+
+func (d *MirroredDevice) WriteZeroes(off, length uint64) error {
+	return d.fanOut("write zeroes", func(mirror BuseInterface) error {
+		return writeZeroes(mirror, off, length)
+	})
+}
+
+func (d *MirroredDevice) Flush() error {
+	return d.fanOut("flush", func(mirror BuseInterface) error {
+		return mirror.Flush()
+	})
+}
+
+func (d *MirroredDevice) Disconnect() {
+	for _, mirror := range d.mirrors {
+		mirror.Disconnect()
+	}
+}
@@ -0,0 +1,98 @@
+//go:build unix
+
+package buse
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// MmapDevice is a read-only driver serving a file from a memory mapping
+type MmapDevice struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// MmapReadOnlyDevice maps the file at path to export it read-only.
+// Reads are copied from the mapping, without a syscall per request.
+func MmapReadOnlyDevice(path string) (*MmapDevice, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return nil, fmt.Errorf("Cannot map %s: the file is empty", path)
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("Cannot map %s: %d bytes do not fit in the address space", path, size)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot map %s: %s", path, err)
+	}
+	return &MmapDevice{data: data}, nil
+}
+
+// Size returns the size of the mapped file
+func (d *MmapDevice) Size() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return uint64(len(d.data))
+}
+
+func (d *MmapDevice) ReadAt(p []byte, off uint64) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	size := uint64(len(d.data))
+	if off > size || uint64(len(p)) > size-off {
+		return fmt.Errorf("Read past the end of the mapping (offset:%d len:%d size:%d)", off, len(p), size)
+	}
+	copy(p, d.data[off:])
+	return nil
+}
+
+func (d *MmapDevice) WriteAt(p []byte, off uint64) error {
+	return ErrReadOnly
+}
+
+func (d *MmapDevice) Trim(off, length uint64) error {
+	return ErrReadOnly
+}
+
+func (d *MmapDevice) Flush() error {
+	return nil
+}
+
+// NeedsFlush is false, there is nothing to flush
+func (d *MmapDevice) NeedsFlush() bool {
+	return false
+}
+
+// CanTrim is false, the device is read-only
+func (d *MmapDevice) CanTrim() bool {
+	return false
+}
+
+// ReadOnly makes the device be advertised read-only to the kernel
+func (d *MmapDevice) ReadOnly() bool {
+	return true
+}
+
+// Disconnect unmaps the file, reads fail afterwards
+func (d *MmapDevice) Disconnect() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.data == nil {
+		return
+	}
+	syscall.Munmap(d.data)
+	d.data = nil
+}
@@ -0,0 +1,57 @@
+package buse
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// execCommand builds the helper commands run by the package
+var execCommand = exec.Command
+
+// moduleLoaded tells whether the nbd kernel module is loaded
+func moduleLoaded() bool {
+	_, err := os.Stat(filepath.Join(sysfsRoot, "module", "nbd"))
+	return err == nil
+}
+
+// loadModule runs modprobe to load the nbd kernel module with the configured parameters
+func loadModule(opts Options) error {
+	args := []string{"nbd"}
+	if opts.NbdsMax > 0 {
+		args = append(args, fmt.Sprintf("nbds_max=%d", opts.NbdsMax))
+	}
+	if opts.MaxPart > 0 {
+		args = append(args, fmt.Sprintf("max_part=%d", opts.MaxPart))
+	}
+	log.Println("Loading the nbd kernel module:", strings.Join(args, " "))
+	cmd := execCommand("modprobe", args...)
+	cmd.SysProcAttr = opts.SysProcAttr
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Cannot load the nbd kernel module: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// openDevice opens the device file, loading the nbd module first when allowed to
+func openDevice(device string, opts Options) (*os.File, error) {
+	fp, err := os.OpenFile(device, os.O_RDWR, 0600)
+	if err == nil || !opts.AutoLoadModule || moduleLoaded() {
+		return fp, err
+	}
+	if err := loadModule(opts); err != nil {
+		return nil, err
+	}
+	// Give udev some time to create the device nodes
+	for i := 0; i < 10; i++ {
+		if fp, err = os.OpenFile(device, os.O_RDWR, 0600); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fp, err
+}
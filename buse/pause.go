@@ -0,0 +1,50 @@
+package buse
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// Pause stops dispatching new requests, waiting for the one being handled
+// to complete. Requests received meanwhile are held until Resume, the kernel
+// queues the next ones. The pause ends on its own when ctx is done, so that a
+// forgotten Resume cannot wedge the device; ctx also bounds the wait for the
+// request in flight.
+func (bd *BuseDevice) Pause(ctx context.Context) error {
+	select {
+	case bd.gate <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if bd.closing.Load() {
+		// Teardown needs the gate to disconnect the driver
+		<-bd.gate
+		return errors.New("Cannot pause a device being closed")
+	}
+	resumed := make(chan struct{})
+	bd.pauseMu.Lock()
+	bd.resumed = resumed
+	bd.pauseMu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Println("Pause expired, resuming I/O")
+			bd.Resume()
+		case <-resumed:
+		}
+	}()
+	return nil
+}
+
+// Resume dispatches requests again after Pause, it does nothing if not paused
+func (bd *BuseDevice) Resume() {
+	bd.pauseMu.Lock()
+	defer bd.pauseMu.Unlock()
+	if bd.resumed == nil {
+		return
+	}
+	close(bd.resumed)
+	bd.resumed = nil
+	<-bd.gate
+}
@@ -0,0 +1,58 @@
+package buse
+
+// Defaults of the request buffer pool, see Options.PoolBytes
+const (
+	defaultPoolBytes       = 8 << 20
+	defaultMaxPooledBuffer = 1 << 20
+)
+
+// bufferPool keeps request buffers for reuse, within a memory budget. It is
+// only used by the serving loop, hence not locked.
+type bufferPool struct {
+	maxBytes  int
+	maxBuffer int
+	align     int
+	bytes     int
+	free      [][]byte
+}
+
+func newBufferPool(opts ServeOptions, align int) *bufferPool {
+	p := &bufferPool{maxBytes: opts.PoolBytes, maxBuffer: opts.MaxPooledBuffer, align: align}
+	if p.maxBytes == 0 {
+		p.maxBytes = defaultPoolBytes
+	}
+	if p.maxBuffer == 0 {
+		p.maxBuffer = defaultMaxPooledBuffer
+	}
+	return p
+}
+
+// get returns a zeroed buffer of n bytes, reusing the smallest one fitting
+func (p *bufferPool) get(n int) []byte {
+	best := -1
+	for i, buf := range p.free {
+		if cap(buf) >= n && (best < 0 || cap(buf) < cap(p.free[best])) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return alignedBuffer(n, p.align)
+	}
+	buf := p.free[best][:n]
+	last := len(p.free) - 1
+	p.free[best] = p.free[last]
+	p.free[last] = nil
+	p.free = p.free[:last]
+	p.bytes -= cap(buf)
+	clear(buf)
+	return buf
+}
+
+// put gives a buffer back, it is dropped if too large for the budget
+func (p *bufferPool) put(buf []byte) {
+	if buf == nil || cap(buf) > p.maxBuffer || p.bytes+cap(buf) > p.maxBytes {
+		return
+	}
+	p.bytes += cap(buf)
+	p.free = append(p.free, buf)
+}
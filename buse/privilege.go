@@ -0,0 +1,39 @@
+package buse
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrInsufficientPrivilege is returned when creating a device without the
+// CAP_SYS_ADMIN capability the nbd ioctls require
+var ErrInsufficientPrivilege = errors.New("CAP_SYS_ADMIN is required to set up an nbd device")
+
+// Bit of CAP_SYS_ADMIN in the capability sets, see <linux/capability.h>
+const capSysAdmin = 21
+
+// hasSysAdmin tells whether the process has CAP_SYS_ADMIN in its effective
+// set. It assumes so when that cannot be found out, the ioctls will tell.
+var hasSysAdmin = func() bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return true
+		}
+		return caps&(1<<capSysAdmin) != 0
+	}
+	return true
+}
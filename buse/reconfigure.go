@@ -0,0 +1,45 @@
+package buse
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reconfigure applies new options while the device keeps serving, they take
+// effect from the next request. It waits for the request in flight, and for
+// Resume if paused.
+//
+// Only the tuning knobs can change: the thresholds and their callbacks,
+// Progress, ZeroFillUnwritten, CoalesceFlushes, RetryUnavailable,
+// ReplyWriteTimeout, ProtectedRanges, DisconnectMode and Timeout. Changing
+// the options fixed at creation is an error. ReplyEncoder, Record, CPUs,
+// IdleTimeout, PoolBytes, MaxPooledBuffer, MaxRequestLength and SysProcAttr
+// are only read when serving starts, they are kept as they were.
+func (bd *BuseDevice) Reconfigure(opts Options) error {
+	bd.gate <- struct{}{}
+	defer func() { <-bd.gate }()
+	old := bd.options()
+	if opts.Rotational != old.Rotational ||
+		opts.AutoLoadModule != old.AutoLoadModule ||
+		opts.NbdsMax != old.NbdsMax || opts.MaxPart != old.MaxPart ||
+		opts.BlockSize != old.BlockSize || opts.PhysicalBlockSize != old.PhysicalBlockSize ||
+		opts.SkipPartitionScan != old.SkipPartitionScan {
+		return errors.New("Only the tuning options can be reconfigured")
+	}
+	if opts.Timeout != old.Timeout && bd.deviceFp != nil {
+		if err := ioctl(bd.deviceFp.Fd(), NBD_SET_TIMEOUT, timeoutSeconds(opts.Timeout)); err != nil {
+			return fmt.Errorf("Cannot set the timeout of %s: %s", bd.device, err)
+		}
+	}
+	opts.ReplyEncoder = old.ReplyEncoder
+	opts.Record = old.Record
+	opts.CPUs = old.CPUs
+	opts.IdleTimeout = old.IdleTimeout
+	// The pool is built once, when serving starts
+	opts.PoolBytes = old.PoolBytes
+	opts.MaxPooledBuffer = old.MaxPooledBuffer
+	opts.MaxRequestLength = old.MaxRequestLength
+	opts.SysProcAttr = old.SysProcAttr
+	bd.opts.Store(&opts)
+	return nil
+}
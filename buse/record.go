@@ -0,0 +1,23 @@
+package buse
+
+import (
+	"errors"
+	"io"
+)
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// Replay feeds the requests recorded with Options.Record to a driver,
+// through the same handlers a connected device uses. Replies are dropped.
+// It returns nil once the whole recording has been replayed.
+func Replay(r io.Reader, driver BuseInterface) error {
+	bd := newBuseDevice(driver, Options{})
+	err := bd.serve(readWriter{r, io.Discard})
+	if errors.Is(err, io.EOF) || err == errDisconnect {
+		return nil
+	}
+	return err
+}
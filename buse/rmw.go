@@ -0,0 +1,99 @@
+package buse
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RMWDevice adapts a driver that only supports whole block I/O: partial
+// blocks are read, patched and written back, so that unaligned requests do
+// not corrupt the surrounding data. Optional interfaces of the inner driver
+// are hidden.
+type RMWDevice struct {
+	BuseInterface
+	blockSize uint64
+	// serializes the read-modify-write cycles touching the same blocks
+	mu sync.Mutex
+}
+
+// NewRMWDevice wraps the inner driver, whose I/O must be aligned on
+// blockSize, which must not be 0
+func NewRMWDevice(inner BuseInterface, blockSize uint64) (*RMWDevice, error) {
+	if blockSize == 0 {
+		return nil, fmt.Errorf("Invalid block size: %d", blockSize)
+	}
+	return &RMWDevice{BuseInterface: inner, blockSize: blockSize}, nil
+}
+
+// blocks returns the aligned range covering length bytes at off
+func (d *RMWDevice) blocks(off, length uint64) (start, end uint64) {
+	start = off / d.blockSize * d.blockSize
+	end = (off + length + d.blockSize - 1) / d.blockSize * d.blockSize
+	return start, end
+}
+
+func (d *RMWDevice) ReadAt(p []byte, off uint64) error {
+	start, end := d.blocks(off, uint64(len(p)))
+	if start == off && end == off+uint64(len(p)) {
+		return d.BuseInterface.ReadAt(p, off)
+	}
+	buf := make([]byte, end-start)
+	if err := d.BuseInterface.ReadAt(buf, start); err != nil {
+		return err
+	}
+	copy(p, buf[off-start:])
+	return nil
+}
+
+func (d *RMWDevice) WriteAt(p []byte, off uint64) error {
+	start, end := d.blocks(off, uint64(len(p)))
+	if start == off && end == off+uint64(len(p)) {
+		return d.BuseInterface.WriteAt(p, off)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	buf := make([]byte, end-start)
+	// Only the partial blocks at both ends need reading
+	if off != start {
+		if err := d.BuseInterface.ReadAt(buf[:d.blockSize], start); err != nil {
+			return err
+		}
+	}
+	if tail := end - d.blockSize; off+uint64(len(p)) != end && (tail != start || off == start) {
+		if err := d.BuseInterface.ReadAt(buf[tail-start:], tail); err != nil {
+			return err
+		}
+	}
+	copy(buf[off-start:], p)
+	return d.BuseInterface.WriteAt(buf, start)
+}
+
+// Trim only discards the whole blocks of the range, it is a hint anyway
+func (d *RMWDevice) Trim(off, length uint64) error {
+	start := (off + d.blockSize - 1) / d.blockSize * d.blockSize
+	end := (off + length) / d.blockSize * d.blockSize
+	if end <= start {
+		return nil
+	}
+	return d.BuseInterface.Trim(start, end-start)
+}
+
+func (d *RMWDevice) WriteZeroes(off, length uint64) error {
+	start := (off + d.blockSize - 1) / d.blockSize * d.blockSize
+	end := (off + length) / d.blockSize * d.blockSize
+	if end <= start {
+		return d.WriteAt(make([]byte, length), off)
+	}
+	if start > off {
+		if err := d.WriteAt(make([]byte, start-off), off); err != nil {
+			return err
+		}
+	}
+	if err := writeZeroes(d.BuseInterface, start, end-start); err != nil {
+		return err
+	}
+	if off+length > end {
+		return d.WriteAt(make([]byte, off+length-end), end)
+	}
+	return nil
+}
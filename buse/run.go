@@ -0,0 +1,34 @@
+package buse
+
+import (
+	"context"
+)
+
+// Run creates the device and serves it until the kernel disconnects it, an
+// error occurs or ctx is done. Cancelling ctx disconnects the device as
+// Disconnect does, or forcibly if the driver vetoes it. The device is
+// closed whatever the outcome, Run returns nil on a disconnection.
+func Run(ctx context.Context, device string, size uint64, buseDriver BuseInterface, opts Options) error {
+	bd, err := CreateDeviceWithOptions(device, size, buseDriver, opts)
+	if err != nil {
+		return err
+	}
+	connected := make(chan error, 1)
+	go func() {
+		connected <- bd.Connect()
+	}()
+	select {
+	case err = <-connected:
+	case <-ctx.Done():
+		bd.Disconnect()
+		if !bd.closing.Load() {
+			// Vetoed, the cancellation has the last word
+			bd.shutdown()
+		}
+		err = <-connected
+	}
+	if cerr := bd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+package buse
+
+import (
+	"errors"
+	"io"
+)
+
+// Serve speaks the NBD transmission protocol over conn on behalf of driver,
+// without any kernel device involved, e.g. to embed it in a larger server.
+// The connection is closed on return, which is nil once the peer
+// disconnected or closed the connection.
+func Serve(conn io.ReadWriteCloser, driver BuseInterface, opts ServeOptions) error {
+	defer conn.Close()
+	bd := newBuseDevice(driver, Options{ServeOptions: opts})
+	bd.conn = conn
+	err := bd.serve(conn)
+	if errors.Is(err, io.EOF) || err == errDisconnect {
+		return nil
+	}
+	return err
+}
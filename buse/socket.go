@@ -0,0 +1,33 @@
+package buse
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// SocketQueues are the bytes queued on the serving end of the socket
+type SocketQueues struct {
+	// Send is the amount of replies not read by the kernel yet, it grows
+	// when the device is reply-bound. On a unix socket it counts the memory
+	// of the queued buffers, overhead included, rather than the data.
+	Send int
+	// Recv is the amount of requests not read by the device yet
+	Recv int
+}
+
+// SocketQueues reports the queues of the socket the requests are served
+// on, to diagnose where the I/O piles up. It is safe to call while serving.
+func (bd *BuseDevice) SocketQueues() (SocketQueues, error) {
+	if bd.closing.Load() {
+		return SocketQueues{}, errors.New("The device socket is closed")
+	}
+	fd := uintptr(bd.socketPair[0])
+	var send, recv int32
+	if err := ioctl(fd, SIOCOUTQ, uintptr(unsafe.Pointer(&send))); err != nil {
+		return SocketQueues{}, err
+	}
+	if err := ioctl(fd, SIOCINQ, uintptr(unsafe.Pointer(&recv))); err != nil {
+		return SocketQueues{}, err
+	}
+	return SocketQueues{Send: int(send), Recv: int(recv)}, nil
+}
@@ -0,0 +1,52 @@
+package buse
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the counters of a device, as returned by BuseDevice.Stats
+type Stats struct {
+	// ReplyWriteTime is the total time spent encoding and writing replies
+	// to the socket, it grows when the kernel does not drain the replies
+	// fast enough
+	ReplyWriteTime time.Duration
+	// DriverTime is the total time spent in the driver calls, retries
+	// included. Compared to ReplyWriteTime it tells which side is slow.
+	DriverTime time.Duration
+	// SlowReplyWrites counts the reply writes that blocked for longer
+	// than Options.SlowReplyThreshold
+	SlowReplyWrites uint64
+	// CoalescedFlushes counts the flushes replied without calling the
+	// driver, see Options.CoalesceFlushes
+	CoalescedFlushes uint64
+	// FreedBytes is the space the trims reclaimed, as reported by a driver
+	// implementing FreeingTrimmer
+	FreedBytes uint64
+}
+
+type stats struct {
+	replyWriteTime   atomic.Int64
+	driverTime       atomic.Int64
+	slowReplyWrites  atomic.Uint64
+	coalescedFlushes atomic.Uint64
+	inFlight         atomic.Int64
+	freedBytes       atomic.Uint64
+}
+
+// Stats returns a snapshot of the device counters. It is safe to call while serving.
+func (bd *BuseDevice) Stats() Stats {
+	return Stats{
+		ReplyWriteTime:   time.Duration(bd.stats.replyWriteTime.Load()),
+		DriverTime:       time.Duration(bd.stats.driverTime.Load()),
+		SlowReplyWrites:  bd.stats.slowReplyWrites.Load(),
+		CoalescedFlushes: bd.stats.coalescedFlushes.Load(),
+		FreedBytes:       bd.stats.freedBytes.Load(),
+	}
+}
+
+// InFlight returns the number of requests being handled, at most one since
+// requests are handled serially. It is safe to call while serving.
+func (bd *BuseDevice) InFlight() int {
+	return int(bd.stats.inFlight.Load())
+}
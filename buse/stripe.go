@@ -0,0 +1,83 @@
+package buse
+
+import (
+	"errors"
+)
+
+// StripedDevice spreads the device over backends in stripes of stripeSize
+// bytes, round robin (RAID0). Requests spanning stripes are split, optional
+// interfaces of the backends are hidden.
+type StripedDevice struct {
+	backends   []BuseInterface
+	stripeSize uint64
+}
+
+// NewStripedDevice stripes the backends, stripeSize should be a multiple of
+// the block size of the device
+func NewStripedDevice(stripeSize uint64, backends ...BuseInterface) (*StripedDevice, error) {
+	if stripeSize == 0 || len(backends) == 0 {
+		return nil, errors.New("Striping needs a stripe size and at least one backend")
+	}
+	return &StripedDevice{backends: backends, stripeSize: stripeSize}, nil
+}
+
+// split calls fn for each part of the range falling in a stripe, with the
+// offset in the backend and the position of the part in the range
+func (d *StripedDevice) split(off, length uint64, fn func(backend BuseInterface, off, length, pos uint64) error) error {
+	n := uint64(len(d.backends))
+	var pos uint64
+	for length > 0 {
+		stripe := off / d.stripeSize
+		inStripe := off % d.stripeSize
+		part := min(length, d.stripeSize-inStripe)
+		backendOff := stripe/n*d.stripeSize + inStripe
+		if err := fn(d.backends[stripe%n], backendOff, part, pos); err != nil {
+			return err
+		}
+		off += part
+		pos += part
+		length -= part
+	}
+	return nil
+}
+
+func (d *StripedDevice) ReadAt(p []byte, off uint64) error {
+	return d.split(off, uint64(len(p)), func(backend BuseInterface, backendOff, n, pos uint64) error {
+		return backend.ReadAt(p[pos:pos+n], backendOff)
+	})
+}
+
+func (d *StripedDevice) WriteAt(p []byte, off uint64) error {
+	return d.split(off, uint64(len(p)), func(backend BuseInterface, backendOff, n, pos uint64) error {
+		return backend.WriteAt(p[pos:pos+n], backendOff)
+	})
+}
+
+func (d *StripedDevice) Trim(off, length uint64) error {
+	return d.split(off, length, func(backend BuseInterface, backendOff, n, pos uint64) error {
+		return backend.Trim(backendOff, n)
+	})
+}
+
+func (d *StripedDevice) WriteZeroes(off, length uint64) error {
+	return d.split(off, length, func(backend BuseInterface, backendOff, n, pos uint64) error {
+		return writeZeroes(backend, backendOff, n)
+	})
+}
+
+// Flush flushes all the backends, even if one fails
+func (d *StripedDevice) Flush() error {
+	var err error
+	for _, backend := range d.backends {
+		if e := backend.Flush(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (d *StripedDevice) Disconnect() {
+	for _, backend := range d.backends {
+		backend.Disconnect()
+	}
+}
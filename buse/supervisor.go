@@ -0,0 +1,77 @@
+package buse
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Supervisor keeps a device connected: when the kernel drops the connection,
+// typically because Options.Timeout fired on a stuck request, the device is
+// set up again and reconnected, up to Retries times. A device disconnected
+// from outside, see ErrDeviceRemoved, is not reconnected.
+type Supervisor struct {
+	Device  string
+	Size    uint64
+	Driver  BuseInterface
+	Options Options
+	// Retries is the reconnection budget
+	Retries int
+	// RetryDelay is waited before each reconnection, one second if 0
+	RetryDelay time.Duration
+
+	mu      sync.Mutex
+	current *BuseDevice
+	stopped bool
+}
+
+// Run connects the device and reconnects it until it is stopped, it
+// disconnects on its own or the retry budget is exhausted.
+func (s *Supervisor) Run() error {
+	delay := s.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		device, err := CreateDeviceWithOptions(s.Device, s.Size, s.Driver, s.Options)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return device.Close()
+		}
+		s.current = device
+		s.mu.Unlock()
+		err = device.Connect()
+		device.Close()
+		s.mu.Lock()
+		stopped := s.stopped
+		s.mu.Unlock()
+		if stopped || err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrDeviceRemoved) {
+			log.Printf("%s disconnected from outside, not reconnecting", s.Device)
+			return err
+		}
+		if attempt >= s.Retries {
+			log.Printf("Giving up on %s after %d reconnections: %s", s.Device, attempt, err)
+			return err
+		}
+		log.Printf("Connection of %s lost (%s), reconnecting (%d/%d)", s.Device, err, attempt+1, s.Retries)
+		time.Sleep(delay)
+	}
+}
+
+// Stop disconnects the device and makes Run return
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	if s.current != nil {
+		s.current.Disconnect()
+	}
+}
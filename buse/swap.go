@@ -0,0 +1,45 @@
+package buse
+
+import (
+	"fmt"
+)
+
+// SwapDriver replaces the driver of the device while it keeps serving,
+// e.g. to migrate to another backend: it waits for the request in flight,
+// and for Resume if paused, and the next requests go to driver. The old
+// driver is neither flushed nor disconnected, the caller owns it and must
+// have brought driver up to date. Both must report the same size and
+// lead to the same flags advertised to the kernel, e.g. both needing
+// flushes or not, and driver must not need buffers more aligned than the
+// old one.
+func (bd *BuseDevice) SwapDriver(driver BuseInterface) error {
+	s, ok := driver.(Sizer)
+	if !ok {
+		return fmt.Errorf("Cannot swap the driver of %s: the new driver has no Size", bd.device)
+	}
+	bd.gate <- struct{}{}
+	defer func() { <-bd.gate }()
+	size := bd.size
+	if old, ok := bd.driver.(Sizer); ok && size == 0 {
+		// Served without a device, the old driver tells the size
+		size = old.Size()
+	}
+	if s.Size() != size {
+		return fmt.Errorf("Cannot swap the driver of %s: size %d, expected %d", bd.device, s.Size(), size)
+	}
+	if bd.deviceFp != nil {
+		// The kernel keeps sending the commands it was told about
+		if flags := deviceFlags(driver, *bd.options()); flags != bd.flags {
+			return fmt.Errorf("Cannot swap the driver of %s: it needs flags %#x, %#x are advertised", bd.device, flags, bd.flags)
+		}
+	}
+	if a, ok := driver.(BufferAligner); ok && a.BufferAlignment() > bd.align {
+		return fmt.Errorf("Cannot swap the driver of %s: needs %d bytes aligned buffers, they are %d bytes aligned", bd.device, a.BufferAlignment(), bd.align)
+	}
+	bd.driverMu.Lock()
+	bd.driver = driver
+	bd.driverMu.Unlock()
+	// Nothing tells what the new driver holds before its first flush
+	bd.unflushed = true
+	return nil
+}
@@ -0,0 +1,103 @@
+package buse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysfsRoot is where sysfs is mounted, it can be pointed to a fake tree
+var sysfsRoot = "/sys"
+
+// devRoot is where the device nodes are, it can be pointed to a fake tree
+var devRoot = "/dev"
+
+// sysfsPath returns the path of an attribute of the device under /sys/block
+func (bd *BuseDevice) sysfsPath(elem ...string) string {
+	return filepath.Join(append([]string{sysfsRoot, "block", filepath.Base(bd.device)}, elem...)...)
+}
+
+// removed tells whether the kernel no longer has a client attached to the
+// device, its pid attribute only exists while NBD_DO_IT runs
+func (bd *BuseDevice) removed() bool {
+	data, err := os.ReadFile(bd.sysfsPath("pid"))
+	if os.IsNotExist(err) {
+		return true
+	}
+	return err == nil && len(strings.TrimSpace(string(data))) == 0
+}
+
+// KernelSize returns the size in bytes of the device as currently reported by the kernel.
+// It is useful to check that the size set when creating the device took effect.
+func (bd *BuseDevice) KernelSize() (uint64, error) {
+	data, err := os.ReadFile(bd.sysfsPath("size"))
+	if err != nil {
+		return 0, fmt.Errorf("Cannot read the kernel size of %s: %s", bd.device, err)
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid kernel size for %s: %s", bd.device, err)
+	}
+	return sectors * sectorSize, nil
+}
+
+// setQueueAttr writes a queue attribute of the device, which fails for read-only ones
+func (bd *BuseDevice) setQueueAttr(name string, value uint64) error {
+	path := bd.sysfsPath("queue", name)
+	if err := os.WriteFile(path, []byte(strconv.FormatUint(value, 10)), 0644); err != nil {
+		return fmt.Errorf("Cannot set queue/%s of %s: %s", name, bd.device, err)
+	}
+	return nil
+}
+
+// SetMaxSectorsKB limits the size of the requests the kernel issues, in KiB
+func (bd *BuseDevice) SetMaxSectorsKB(kb uint64) error {
+	if kb == 0 {
+		return fmt.Errorf("Invalid max_sectors_kb: 0")
+	}
+	return bd.setQueueAttr("max_sectors_kb", kb)
+}
+
+// SetDiscardGranularity advertises the discard granularity of the backend in
+// bytes, it must be a power of two of at least 512. Kernels exposing the
+// attribute read-only make it return an error.
+func (bd *BuseDevice) SetDiscardGranularity(granularity uint64) error {
+	if granularity < sectorSize || granularity&(granularity-1) != 0 {
+		return fmt.Errorf("Invalid discard granularity %d: must be a power of two of at least %d", granularity, sectorSize)
+	}
+	return bd.setQueueAttr("discard_granularity", granularity)
+}
+
+// DisconnectAll disconnects every nbd device of the host with a client
+// attached, e.g. the devices left bound by a crashed process. It returns
+// the errors met, one per device failing to disconnect.
+func DisconnectAll() []error {
+	paths, err := filepath.Glob(filepath.Join(sysfsRoot, "block", "nbd*"))
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, path := range paths {
+		name := filepath.Base(path)
+		// The pid attribute only exists while a client is attached
+		data, err := os.ReadFile(filepath.Join(path, "pid"))
+		if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+		device := filepath.Join(devRoot, name)
+		fp, err := os.OpenFile(device, os.O_RDWR, 0600)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Cannot open %s: %s", device, err))
+			continue
+		}
+		if err := ioctl(fp.Fd(), NBD_DISCONNECT, 0); err != nil {
+			errs = append(errs, fmt.Errorf("Cannot disconnect %s: %s", device, err))
+		} else if err := ioctl(fp.Fd(), NBD_CLEAR_SOCK, 0); err != nil {
+			errs = append(errs, fmt.Errorf("Cannot clear the socket of %s: %s", device, err))
+		}
+		fp.Close()
+	}
+	return errs
+}
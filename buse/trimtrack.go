@@ -0,0 +1,86 @@
+package buse
+
+import (
+	"sort"
+	"sync"
+)
+
+// TrimTracker wraps a driver to record which extents are trimmed, e.g. to
+// back up only live data. Adjacent trims are coalesced and writes clear the
+// ranges they cover. Optional interfaces of the inner driver are hidden.
+type TrimTracker struct {
+	BuseInterface
+	mu sync.Mutex
+	// sorted, neither overlapping nor adjacent
+	extents []Extent
+}
+
+// NewTrimTracker wraps the inner driver
+func NewTrimTracker(inner BuseInterface) *TrimTracker {
+	return &TrimTracker{BuseInterface: inner}
+}
+
+func (t *TrimTracker) Trim(off, length uint64) error {
+	if err := t.BuseInterface.Trim(off, length); err != nil {
+		return err
+	}
+	if length > 0 {
+		t.add(Extent{off, off + length})
+	}
+	return nil
+}
+
+func (t *TrimTracker) WriteAt(p []byte, off uint64) error {
+	// Even a failed write may have landed partially
+	t.remove(Extent{off, off + uint64(len(p))})
+	return t.BuseInterface.WriteAt(p, off)
+}
+
+func (t *TrimTracker) WriteZeroes(off, length uint64) error {
+	t.remove(Extent{off, off + length})
+	return writeZeroes(t.BuseInterface, off, length)
+}
+
+// TrimmedRanges returns the trimmed extents not written since, in order
+func (t *TrimTracker) TrimmedRanges() []Extent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Extent(nil), t.extents...)
+}
+
+func (t *TrimTracker) add(e Extent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	extents := make([]Extent, 0, len(t.extents)+1)
+	for _, x := range t.extents {
+		if x.End < e.Start || e.End < x.Start {
+			extents = append(extents, x)
+			continue
+		}
+		// Overlapping or adjacent, merge into e
+		e.Start = min(e.Start, x.Start)
+		e.End = max(e.End, x.End)
+	}
+	extents = append(extents, e)
+	sort.Slice(extents, func(i, j int) bool { return extents[i].Start < extents[j].Start })
+	t.extents = extents
+}
+
+func (t *TrimTracker) remove(e Extent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	extents := make([]Extent, 0, len(t.extents)+1)
+	for _, x := range t.extents {
+		if !x.Overlaps(e.Start, e.End-e.Start) {
+			extents = append(extents, x)
+			continue
+		}
+		if x.Start < e.Start {
+			extents = append(extents, Extent{x.Start, e.Start})
+		}
+		if e.End < x.End {
+			extents = append(extents, Extent{e.End, x.End})
+		}
+	}
+	t.extents = extents
+}
@@ -1,7 +1,13 @@
 package buse
 
 import (
+	"io"
+	"math"
 	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Rewrote type definitions for #defines and structs to workaround cgo
@@ -21,27 +27,67 @@ const (
 	NBD_SET_FLAGS       = (0xab<<8 | 10)
 )
 
+// As defined in <linux/fs.h>
+const (
+	BLKRRPART = (0x12<<8 | 95)
+)
+
+// As defined in <linux/sockios.h>
+const (
+	SIOCINQ  = 0x541B
+	SIOCOUTQ = 0x5411
+)
+
 const (
 	NBD_CMD_READ  = 0
 	NBD_CMD_WRITE = 1
 	NBD_CMD_DISC  = 2
 	NBD_CMD_FLUSH = 3
 	NBD_CMD_TRIM  = 4
+	NBD_CMD_CACHE = 5
+
+	NBD_CMD_WRITE_ZEROES = 6
+	// The upper 16 bits of the request type hold the command flags
+	NBD_CMD_MASK_COMMAND = 0xffff
 )
 
 const (
 	NBD_FLAG_HAS_FLAGS  = (1 << 0)
 	NBD_FLAG_READ_ONLY  = (1 << 1)
 	NBD_FLAG_SEND_FLUSH = (1 << 2)
+	NBD_FLAG_ROTATIONAL = (1 << 4)
 	NBD_FLAG_SEND_TRIM  = (1 << 5)
+
+	NBD_FLAG_SEND_WRITE_ZEROES = (1 << 6)
+	NBD_FLAG_CAN_MULTI_CONN    = (1 << 8)
 )
 
+// Error codes sent back in replies, as defined by the NBD protocol
 const (
-	NBD_REQUEST_MAGIC = 0x25609513
-	NBD_REPLY_MAGIC   = 0x67446698
+	NBD_EPERM     = 1
+	NBD_EIO       = 5
+	NBD_ENOMEM    = 12
+	NBD_EINVAL    = 22
+	NBD_ENOSPC    = 28
+	NBD_EOVERFLOW = 75
+	NBD_ENOTSUP   = 95
+	NBD_ESHUTDOWN = 108
 )
 
-type nbdRequest struct {
+// MaxDeviceSize is the largest size the kernel accepts, sizes are kept as loff_t
+const MaxDeviceSize = math.MaxInt64
+
+// The kernel uses 1024 bytes blocks unless told otherwise
+const defaultBlockSize = 1024
+
+const (
+	NBD_REQUEST_MAGIC          = 0x25609513
+	NBD_EXTENDED_REQUEST_MAGIC = 0x21e41c71
+	NBD_REPLY_MAGIC            = 0x67446698
+)
+
+// Request is the header of a request sent by the kernel, see MarshalRequest
+type Request struct {
 	Magic  uint32
 	Type   uint32
 	Handle uint64
@@ -49,26 +95,324 @@ type nbdRequest struct {
 	Length uint32
 }
 
-type nbdReply struct {
+// ExtendedRequest is the header of a request once the extended headers are
+// negotiated, the length is 64 bits. The kernel never negotiates them, it is
+// for servers speaking NBD over the network, see MarshalExtendedRequest.
+type ExtendedRequest struct {
+	Magic  uint32
+	Type   uint32
+	Handle uint64
+	From   uint64
+	Length uint64
+}
+
+// Reply is the header of a simple reply, see MarshalReply
+type Reply struct {
 	Magic  uint32
 	Error  uint32
 	Handle uint64
 }
 
+// BuseInterface is implemented by block device drivers. Offsets and lengths
+// are uint64 to match the NBD wire format regardless of the platform word size.
+//
+// Trim is a discard hint: the content of the range becomes undefined, not
+// zeroed, until written again. Drivers that cannot discard should do nothing
+// and return nil. Zeroing a range is done with WriteZeroes, see WriteZeroer.
+//
+// Requests are handled one at a time in the order the kernel sends them, a
+// call returns before the next one starts. Overlapping operations are thus
+// never concurrent and a read sees all the writes replied before it.
 type BuseInterface interface {
-	ReadAt(p []byte, off uint) error
-	WriteAt(p []byte, off uint) error
+	ReadAt(p []byte, off uint64) error
+	WriteAt(p []byte, off uint64) error
 	Disconnect()
 	Flush() error
-	Trim(off uint, length uint) error
+	Trim(off uint64, length uint64) error
+}
+
+// WriteZeroer may be implemented by a driver able to zero a range efficiently.
+// Otherwise zeroes are written with WriteAt. Unlike Trim, the range must read
+// back as zeroes afterwards.
+type WriteZeroer interface {
+	WriteZeroes(off uint64, length uint64) error
+}
+
+// Extent is the [Start,End) byte range of a device
+type Extent struct {
+	Start uint64
+	End   uint64
+}
+
+// Overlaps tells whether the extent intersects length bytes at off
+func (e Extent) Overlaps(off, length uint64) bool {
+	return length > 0 && off < e.End && e.Start < off+length
+}
+
+// BufferAligner may be implemented by a driver needing aligned buffers,
+// e.g. doing O_DIRECT I/O. The buffers of ReadAt and WriteAt are then
+// aligned in memory to BufferAlignment bytes, a power of two.
+type BufferAligner interface {
+	BufferAlignment() int
+}
+
+// ReadBufferProvider may be implemented by a driver managing its own
+// memory, e.g. a slab cache. The buffers of the reads are then taken with
+// GetReadBuffer, which must return length bytes, and given back with
+// PutReadBuffer once the reply is sent.
+type ReadBufferProvider interface {
+	GetReadBuffer(length uint64) []byte
+	PutReadBuffer(buf []byte)
+}
+
+// RangeFlusher may be implemented by a driver able to flush part of the
+// device. It is used for flush requests carrying a range, Flush otherwise.
+type RangeFlusher interface {
+	FlushRange(off, length uint64) error
+}
+
+// FreeingTrimmer may be implemented by a driver reclaiming space on trims.
+// TrimFreeing is then called instead of Trim, it returns the number of
+// bytes actually freed, accumulated in Stats.FreedBytes.
+type FreeingTrimmer interface {
+	TrimFreeing(off, length uint64) (freed uint64, err error)
+}
+
+// DirtyReporter may be implemented by a driver knowing whether it holds
+// unflushed data. Flush requests are skipped while IsDirty returns false.
+type DirtyReporter interface {
+	IsDirty() bool
+}
+
+// ReadOnlyReporter may be implemented by a driver refusing writes, the
+// device is then advertised read-only to the kernel.
+type ReadOnlyReporter interface {
+	ReadOnly() bool
+}
+
+// FlushReporter may be implemented by a driver whose Flush does nothing,
+// e.g. with no volatile cache. NBD_FLAG_SEND_FLUSH is advertised unless
+// NeedsFlush returns false, the kernel then sends no flushes.
+type FlushReporter interface {
+	NeedsFlush() bool
+}
+
+// TrimReporter may be implemented by a driver whose Trim does nothing.
+// NBD_FLAG_SEND_TRIM is advertised unless CanTrim returns false, the kernel
+// then sends no trims.
+type TrimReporter interface {
+	CanTrim() bool
+}
+
+// MultiConnReporter may be implemented by a driver whose data stays
+// coherent across several connections to the same export, e.g. a flush on
+// one covering the writes of the others. NBD_FLAG_CAN_MULTI_CONN is only
+// advertised when MultiConn returns true.
+type MultiConnReporter interface {
+	MultiConn() bool
+}
+
+// ZeroReporter may be implemented by a driver knowing which regions were
+// never written. Reads of such regions are replied zeroes without ReadAt.
+type ZeroReporter interface {
+	IsZero(off, length uint64) bool
+}
+
+// ConnectObserver may be implemented by a driver that needs to set up
+// when the device connects, e.g. to open a remote session. OnConnect is
+// called by Connect before any request is served, an error aborts the
+// connection. Disconnect is the teardown counterpart.
+type ConnectObserver interface {
+	OnConnect() error
+}
+
+// DisconnectVetoer may be implemented by a driver that must not be
+// disconnected at times, e.g. while in a critical section. A voluntary
+// BuseDevice.Disconnect is refused while CanDisconnect returns an error.
+type DisconnectVetoer interface {
+	CanDisconnect() error
+}
+
+// Sizer is implemented by a driver knowing the size of its backend,
+// SwapDriver requires it.
+type Sizer interface {
+	Size() uint64
 }
 
 type BuseDevice struct {
-	size       uint
+	size       uint64
+	blockSize  uint64
 	device     string
 	driver     BuseInterface
 	deviceFp   *os.File
 	socketPair [2]int
-	op         [5]func(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error
+	op         [7]func(bd *BuseDevice, fp io.ReadWriter, chunk []byte, request *Request, reply *Reply) error
 	disconnect chan int
+	opts       atomic.Pointer[Options]
+	encoder    ReplyEncoder
+	flags      uint32
+	wg         sync.WaitGroup
+	closeOnce  sync.Once
+	closeErr   error
+	clearErr   error
+	closing    atomic.Bool
+	errMu      sync.Mutex
+	err        error
+	stats      stats
+	// unflushed is set once data changed since the last driver flush
+	unflushed bool
+	connected atomic.Bool
+	served    chan struct{}
+	// conn is the connection given to Serve, closed on teardown
+	conn io.Closer
+	// alignment of the request buffers, from the driver at creation
+	align int
+	// gate is held while dispatching a request, or while paused
+	gate    chan struct{}
+	pauseMu sync.Mutex
+	resumed chan struct{}
+	// driverMu guards driver for the readers not holding the gate, the
+	// request handlers read it directly
+	driverMu sync.RWMutex
+	// disconnecting is set once Disconnect was called
+	disconnecting atomic.Bool
+	// doItErr receives the result of NBD_DO_IT
+	doItErr chan error
+	// sock is the serving end of the socket pair, socketPair[0]
+	sock *os.File
+	// startMu orders handing the socket to the kernel with teardown
+	startMu sync.Mutex
+	// disconnectOnce runs the Disconnect of the driver, see disconnectDriver
+	disconnectOnce sync.Once
+}
+
+// ServeOptions tunes the serving of the NBD requests over a connection,
+// the zero value gives the default behavior.
+type ServeOptions struct {
+	// ReplyEncoder serializes the replies, SimpleReplyEncoder is used when nil
+	ReplyEncoder ReplyEncoder
+	// ProtectedRanges are never written nor trimmed, such requests are
+	// replied with EPERM without reaching the driver. Reads are allowed.
+	ProtectedRanges []Extent
+	// Record receives a copy of the request stream read from the kernel,
+	// NBD request headers each followed by its write payload if any.
+	// It can be fed back to a driver with Replay.
+	Record io.Writer
+	// SlowReplyThreshold logs a warning, and calls OnSlowReply if set,
+	// whenever writing a reply blocks for longer. Disabled if 0.
+	SlowReplyThreshold time.Duration
+	OnSlowReply        func(blocked time.Duration)
+	// ReplyWriteTimeout bounds how long writing a reply may block: past it
+	// the peer is deemed stuck and the device is torn down with
+	// ErrReplyStalled. Writes block as long as needed if 0.
+	ReplyWriteTimeout time.Duration
+	// Progress is called when the handling of each request starts and
+	// finishes, e.g. to display the activity of the device
+	Progress func(ProgressEvent)
+	// SlowOpThreshold logs a warning for each driver call lasting longer,
+	// to surface backend stalls. Disabled if 0.
+	SlowOpThreshold time.Duration
+	// ZeroFillUnwritten replies zeroes to reads failing with ErrUnwritten,
+	// so that a fresh device has a deterministic content
+	ZeroFillUnwritten bool
+	// CoalesceFlushes replies success to a flush without calling the
+	// driver when nothing was written since the previous flush, which
+	// already covers all acknowledged writes. It absorbs flush storms.
+	CoalesceFlushes bool
+	// RetryUnavailable retries the driver calls failing with ErrUnavailable,
+	// with a backoff, for up to that long before replying the error. The
+	// kernel then sees a slow request instead of an I/O error. Disabled if 0.
+	RetryUnavailable time.Duration
+	// PanicHandler, if set, is called with the value and the stack of a
+	// panic of the driver, which is then recovered: the request is replied
+	// EIO and the device keeps serving, or fails with PanicTeardown. The
+	// optional calls are covered too: a panicking IsZero or IsDirty counts
+	// as false or true, OnConnect and CanDisconnect as a refusal.
+	PanicHandler  func(recovered any, stack []byte)
+	PanicTeardown bool
+	// IdleTimeout disconnects the device, as Disconnect does, when no
+	// request arrives for that long. Disabled if 0.
+	IdleTimeout time.Duration
+	// PoolBytes caps the memory kept to reuse the request buffers, 8 MiB if
+	// 0, and MaxPooledBuffer the size of the buffers kept, 1 MiB if 0.
+	// Pooling is disabled if negative. Drivers must not retain the buffers
+	// past their calls, like io.ReaderAt and io.WriterAt.
+	PoolBytes       int
+	MaxPooledBuffer int
+	// MaxRequestLength caps the length of the reads and writes, 32 MiB if 0.
+	// Longer reads are replied EINVAL, longer writes fail the connection as
+	// their payload cannot be read in.
+	MaxRequestLength uint32
+	// DecodeHandle renders the request handles, as sent by the kernel, in
+	// the logs, e.g. to split the cookie and tag of blk-mq. Hexadecimal if nil.
+	DecodeHandle func(handle [8]byte) string
+	// CPUs pins the serving loop, and the driver calls it makes, to these
+	// CPUs. The loop gets an OS thread of its own, other goroutines
+	// including the ones the driver starts are still scheduled anywhere.
+	CPUs []int
+}
+
+// Options tunes a BuseDevice, the zero value gives the default behavior.
+type Options struct {
+	ServeOptions
+	// Rotational advertises the device as rotational (like a spinning disk)
+	// so the kernel I/O scheduler optimizes for seeks. Devices are
+	// non-rotational (SSD-like) by default.
+	Rotational bool
+	// AutoLoadModule runs `modprobe nbd' when the device cannot be opened
+	// and the module is not loaded. It needs root and changes the system
+	// state, hence it is off by default.
+	AutoLoadModule bool
+	// NbdsMax and MaxPart are passed as the nbds_max and max_part module
+	// parameters when loading the module, the module defaults apply if 0.
+	NbdsMax int
+	MaxPart int
+	// SysProcAttr is set on the helper commands run by the package, like
+	// modprobe, e.g. to run them in other namespaces or in a cgroup
+	SysProcAttr *syscall.SysProcAttr
+	// BlockSize is the logical block size of the device, the addressing
+	// unit, 1024 if 0. PhysicalBlockSize is the unit the backend writes
+	// atomically, BlockSize if 0. Both are powers of two from 512 to the
+	// page size, physical no smaller than logical. The nbd driver has no
+	// way to advertise the physical size, the kernel reports the logical
+	// one for both: it is only checked and reported by Config.
+	BlockSize         uint64
+	PhysicalBlockSize uint64
+	// Timeout makes the kernel drop the connection when a request is not
+	// replied in time, see Supervisor to reconnect. The kernel default
+	// applies if 0, it only has a one second resolution: the timeout is
+	// rounded up to whole seconds.
+	Timeout time.Duration
+	// SkipPartitionScan skips the BLKRRPART partition table re-read Connect
+	// issues once the kernel reports the size of the device. Useful when no
+	// partition table is expected.
+	SkipPartitionScan bool
+	// DisconnectMode tells what Disconnect does with the pending requests
+	DisconnectMode DisconnectMode
+}
+
+// DisconnectMode tells what a voluntary Disconnect does with pending requests
+type DisconnectMode int
+
+const (
+	// FlushPending serves the requests already queued by the kernel and
+	// flushes the driver before tearing down. It is the default.
+	FlushPending DisconnectMode = iota
+	// DiscardPending tears down right away, the kernel fails the
+	// requests still queued
+	DiscardPending
+)
+
+// ProgressEvent reports the progress of a request to Options.Progress
+type ProgressEvent struct {
+	Command uint32
+	Handle  uint64
+	Offset  uint64
+	Length  uint32
+	// Done is false when the request starts, true once it is replied
+	Done bool
+	// Bytes is the amount of data transferred for the request so far
+	Bytes uint64
+	// Error is the error code of the reply, when done
+	Error uint32
 }
@@ -0,0 +1,29 @@
+package buse
+
+// version of the package, reported by Version
+const version = "0.1.0"
+
+// Info describes the package and the parts of the NBD protocol it implements
+type Info struct {
+	Version string
+	// Commands are the NBD commands handled
+	Commands []string
+	// Flags are the transmission flags a device may advertise
+	Flags []string
+}
+
+// Version returns the version of the package and the protocol features it
+// implements, e.g. to include in bug reports
+func Version() Info {
+	info := Info{
+		Version: version,
+		Flags:   []string{"READ_ONLY", "SEND_FLUSH", "ROTATIONAL", "SEND_TRIM", "SEND_WRITE_ZEROES", "CAN_MULTI_CONN"},
+	}
+	bd := newBuseDevice(nil, Options{})
+	for command, op := range bd.op {
+		if op != nil {
+			info.Commands = append(info.Commands, commandName(uint32(command)))
+		}
+	}
+	return info
+}
@@ -0,0 +1,120 @@
+package buse
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Sizes of the headers on the wire, Go structs may be padded differently
+const (
+	requestSize         = 28
+	extendedRequestSize = 32
+	replySize           = 16
+)
+
+var commandNames = map[uint32]string{
+	NBD_CMD_READ:         "READ",
+	NBD_CMD_WRITE:        "WRITE",
+	NBD_CMD_DISC:         "DISC",
+	NBD_CMD_FLUSH:        "FLUSH",
+	NBD_CMD_TRIM:         "TRIM",
+	NBD_CMD_CACHE:        "CACHE",
+	NBD_CMD_WRITE_ZEROES: "WRITE_ZEROES",
+}
+
+// commandName returns the name of the command of a request type, for logging
+func commandName(requestType uint32) string {
+	if name, ok := commandNames[requestType&NBD_CMD_MASK_COMMAND]; ok {
+		return name
+	}
+	return fmt.Sprintf("CMD_%d", requestType&NBD_CMD_MASK_COMMAND)
+}
+
+// MarshalRequest encodes a request header in the big-endian NBD wire format
+func MarshalRequest(request *Request) []byte {
+	buf := make([]byte, requestSize)
+	binary.BigEndian.PutUint32(buf[0:4], request.Magic)
+	binary.BigEndian.PutUint32(buf[4:8], request.Type)
+	binary.BigEndian.PutUint64(buf[8:16], request.Handle)
+	binary.BigEndian.PutUint64(buf[16:24], request.From)
+	binary.BigEndian.PutUint32(buf[24:28], request.Length)
+	return buf
+}
+
+// UnmarshalRequest decodes a request header from the NBD wire format
+func UnmarshalRequest(buf []byte, request *Request) error {
+	if len(buf) < requestSize {
+		return fmt.Errorf("Request too short: %d bytes", len(buf))
+	}
+	request.Magic = binary.BigEndian.Uint32(buf)
+	request.Type = binary.BigEndian.Uint32(buf[4:8])
+	request.Handle = binary.BigEndian.Uint64(buf[8:16])
+	request.From = binary.BigEndian.Uint64(buf[16:24])
+	request.Length = binary.BigEndian.Uint32(buf[24:28])
+	return nil
+}
+
+// MarshalExtendedRequest encodes an extended request header in the
+// big-endian NBD wire format
+func MarshalExtendedRequest(request *ExtendedRequest) []byte {
+	buf := make([]byte, extendedRequestSize)
+	binary.BigEndian.PutUint32(buf[0:4], request.Magic)
+	binary.BigEndian.PutUint32(buf[4:8], request.Type)
+	binary.BigEndian.PutUint64(buf[8:16], request.Handle)
+	binary.BigEndian.PutUint64(buf[16:24], request.From)
+	binary.BigEndian.PutUint64(buf[24:32], request.Length)
+	return buf
+}
+
+// UnmarshalExtendedRequest decodes an extended request header from the NBD
+// wire format
+func UnmarshalExtendedRequest(buf []byte, request *ExtendedRequest) error {
+	if len(buf) < extendedRequestSize {
+		return fmt.Errorf("Extended request too short: %d bytes", len(buf))
+	}
+	request.Magic = binary.BigEndian.Uint32(buf)
+	request.Type = binary.BigEndian.Uint32(buf[4:8])
+	request.Handle = binary.BigEndian.Uint64(buf[8:16])
+	request.From = binary.BigEndian.Uint64(buf[16:24])
+	request.Length = binary.BigEndian.Uint64(buf[24:32])
+	return nil
+}
+
+// Request converts an extended request to a classic one for the handlers,
+// the length must be at most maxLength, e.g. the largest request a server is
+// willing to buffer
+func (request *ExtendedRequest) Request(maxLength uint32) (Request, error) {
+	if request.Magic != NBD_EXTENDED_REQUEST_MAGIC {
+		return Request{}, fmt.Errorf("Wrong extended request magic: %#x", request.Magic)
+	}
+	if request.Length > uint64(maxLength) {
+		return Request{}, fmt.Errorf("Request of %d bytes, the maximum is %d", request.Length, maxLength)
+	}
+	return Request{
+		Magic:  NBD_REQUEST_MAGIC,
+		Type:   request.Type,
+		Handle: request.Handle,
+		From:   request.From,
+		Length: uint32(request.Length),
+	}, nil
+}
+
+// MarshalReply encodes a simple reply header in the big-endian NBD wire format
+func MarshalReply(reply *Reply) []byte {
+	buf := make([]byte, replySize)
+	binary.BigEndian.PutUint32(buf[0:4], reply.Magic)
+	binary.BigEndian.PutUint32(buf[4:8], reply.Error)
+	binary.BigEndian.PutUint64(buf[8:16], reply.Handle)
+	return buf
+}
+
+// UnmarshalReply decodes a simple reply header from the NBD wire format
+func UnmarshalReply(buf []byte, reply *Reply) error {
+	if len(buf) < replySize {
+		return fmt.Errorf("Reply too short: %d bytes", len(buf))
+	}
+	reply.Magic = binary.BigEndian.Uint32(buf[0:4])
+	reply.Error = binary.BigEndian.Uint32(buf[4:8])
+	reply.Handle = binary.BigEndian.Uint64(buf[8:16])
+	return nil
+}
@@ -0,0 +1,94 @@
+package buse
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A write of 4096 bytes at 1 MiB, as sent by the kernel
+var wireRequestBytes = []byte{
+	0x25, 0x60, 0x95, 0x13, // magic
+	0x00, 0x01, 0x00, 0x01, // type: FUA flag, WRITE
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // handle
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, // from
+	0x00, 0x00, 0x10, 0x00, // length
+}
+
+var wireRequest = Request{
+	Magic:  NBD_REQUEST_MAGIC,
+	Type:   1<<16 | NBD_CMD_WRITE,
+	Handle: 0x0102030405060708,
+	From:   1 << 20,
+	Length: 4096,
+}
+
+func TestMarshalRequest(t *testing.T) {
+	buf := MarshalRequest(&wireRequest)
+	if !bytes.Equal(buf, wireRequestBytes) {
+		t.Fatalf("MarshalRequest = % x, want % x", buf, wireRequestBytes)
+	}
+}
+
+func TestUnmarshalRequest(t *testing.T) {
+	var got Request
+	if err := UnmarshalRequest(wireRequestBytes, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != wireRequest {
+		t.Fatalf("UnmarshalRequest = %+v, want %+v", got, wireRequest)
+	}
+	if err := UnmarshalRequest(wireRequestBytes[:requestSize-1], &got); err == nil {
+		t.Fatal("UnmarshalRequest accepted a truncated header")
+	}
+}
+
+func TestMarshalReply(t *testing.T) {
+	want := []byte{
+		0x67, 0x44, 0x66, 0x98, // magic
+		0x00, 0x00, 0x00, 0x05, // error: EIO
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // handle
+	}
+	reply := Reply{Magic: NBD_REPLY_MAGIC, Error: NBD_EIO, Handle: 0x0102030405060708}
+	buf := MarshalReply(&reply)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("MarshalReply = % x, want % x", buf, want)
+	}
+	var got Reply
+	if err := UnmarshalReply(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != reply {
+		t.Fatalf("UnmarshalReply = %+v, want %+v", got, reply)
+	}
+}
+
+func TestMarshalExtendedRequest(t *testing.T) {
+	want := []byte{
+		0x21, 0xe4, 0x1c, 0x71, // magic
+		0x00, 0x00, 0x00, 0x00, // type: READ
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // handle
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, // from
+		0x00, 0x00, 0x00, 0x01, 0x40, 0x00, 0x00, 0x00, // length: 5 GiB
+	}
+	request := ExtendedRequest{
+		Magic:  NBD_EXTENDED_REQUEST_MAGIC,
+		Type:   NBD_CMD_READ,
+		Handle: 0x0102030405060708,
+		From:   4096,
+		Length: 5 << 30,
+	}
+	buf := MarshalExtendedRequest(&request)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("MarshalExtendedRequest = % x, want % x", buf, want)
+	}
+	var got ExtendedRequest
+	if err := UnmarshalExtendedRequest(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != request {
+		t.Fatalf("UnmarshalExtendedRequest = %+v, want %+v", got, request)
+	}
+	if _, err := got.Request(32 << 20); err == nil {
+		t.Fatal("Request accepted a length above the maximum")
+	}
+}
@@ -16,13 +16,13 @@ type DeviceExample struct {
 	dataset []byte
 }
 
-func (d *DeviceExample) ReadAt(p []byte, off uint) error {
-	copy(p, d.dataset[off:int(off)+len(p)])
+func (d *DeviceExample) ReadAt(p []byte, off uint64) error {
+	copy(p, d.dataset[off:off+uint64(len(p))])
 	log.Printf("[DeviceExample] READ offset:%d len:%d\n", off, len(p))
 	return nil
 }
 
-func (d *DeviceExample) WriteAt(p []byte, off uint) error {
+func (d *DeviceExample) WriteAt(p []byte, off uint64) error {
 	copy(d.dataset[off:], p)
 	log.Printf("[DeviceExample] WRITE offset:%d len:%d\n", off, len(p))
 	return nil
@@ -37,7 +37,7 @@ func (d *DeviceExample) Flush() error {
 	return nil
 }
 
-func (d *DeviceExample) Trim(off, length uint) error {
+func (d *DeviceExample) Trim(off, length uint64) error {
 	log.Printf("[DeviceExample] TRIM offset:%d len:%d\n", off, length)
 	return nil
 }
@@ -55,7 +55,7 @@ func main() {
 	if len(args) < 1 {
 		usage()
 	}
-	size := uint(1024 * 1024 * 512) // 512M
+	size := uint64(1024 * 1024 * 512) // 512M
 	deviceExp := &DeviceExample{}
 	deviceExp.dataset = make([]byte, size)
 	device, err := buse.CreateDevice(args[0], size, deviceExp)
@@ -63,7 +63,7 @@ func main() {
 		fmt.Printf("Cannot create device: %s\n", err)
 		os.Exit(1)
 	}
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 	go func() {
 		if err := device.Connect(); err != nil {